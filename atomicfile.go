@@ -0,0 +1,63 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic : replace a file so that readers see either the old or the new content,
+// even if we crash or the disk fills up halfway through
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	temp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempName := temp.Name()
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempName, perm)
+	}
+	if err == nil {
+		err = os.Rename(tempName, filename)
+	}
+	if err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	// Persist the rename itself
+	dir, err := os.Open(filepath.Dir(filename))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
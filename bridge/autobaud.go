@@ -0,0 +1,220 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const defaultAutobaudListen = 1000 * time.Millisecond
+
+var errAutobaudRequested = errors.New("baudrate detection requested")
+
+// AutobaudConfig : parameters of the automatic baud rate detection
+type AutobaudConfig struct {
+	// detect the baud rate each time the port is opened
+	Enabled bool `json:"enabled"`
+	// request sent at each baud rate (escaped like the packet separator), nothing when empty
+	Probe string `json:"probe"`
+	// regular expression the reply to the probe must match
+	Expect string `json:"expect"`
+	// time spent listening at each baud rate, in milliseconds
+	Listen int `json:"listen"`
+}
+
+// AutobaudScore : what was received at one baud rate
+type AutobaudScore struct {
+	BaudRate      int     `json:"baudrate"`
+	Bytes         int     `json:"bytes"`
+	FramingErrors int     `json:"framingErrors"`
+	Printable     float64 `json:"printable"`
+	Matched       bool    `json:"matched"`
+	Score         float64 `json:"score"`
+}
+
+// AutobaudResult : outcome of a baud rate detection
+type AutobaudResult struct {
+	BaudRate int             `json:"baudrate"`
+	Scores   []AutobaudScore `json:"scores"`
+	Applied  bool            `json:"applied"`
+}
+
+// autobaudRequest : asks a running port to detect its baud rate
+type autobaudRequest struct {
+	options AutobaudConfig
+	result  chan autobaudResponse
+}
+
+type autobaudResponse struct {
+	result AutobaudResult
+	err    error
+}
+
+// requestAutobaud : have a running port detect its baud rate
+func (handle *portHandle) requestAutobaud(options AutobaudConfig) (AutobaudResult, error) {
+	request := autobaudRequest{options, make(chan autobaudResponse, 1)}
+
+	select {
+	case handle.autobaudRequests <- request:
+	case <-time.After(5 * time.Second):
+		return AutobaudResult{}, errors.New("timed out waiting for the port thread")
+	}
+
+	response := <-request.result
+	return response.result, response.err
+}
+
+// scoreAutobaud : rate the traffic received at one baud rate, the higher the more plausible
+func scoreAutobaud(score *AutobaudScore, received []byte, expect *regexp.Regexp) {
+	score.Bytes = len(received)
+
+	if len(received) > 0 {
+		printable := 0
+		for _, b := range received {
+			if (b >= 0x20 && b < 0x7f) || b == '\r' || b == '\n' || b == '\t' {
+				printable++
+			}
+		}
+		score.Printable = float64(printable) / float64(len(received))
+	}
+
+	if expect != nil && expect.Match(received) {
+		score.Matched = true
+		score.Score = 1000
+		return
+	}
+
+	if len(received) == 0 {
+		return
+	}
+
+	// Framing errors are the strongest hint of a wrong rate, printable text a weaker hint of a right one
+	errorRate := float64(score.FramingErrors) / float64(len(received)+score.FramingErrors)
+	score.Score = 100 * (1 - errorRate) * (0.5 + 0.5*score.Printable)
+}
+
+// detectBaudRate : try every baud rate on a tty and pick the one whose traffic looks the most plausible
+func detectBaudRate(ttyName string, portConfig PortConfig, baudRates []int, options AutobaudConfig, logger Logger) (AutobaudResult, error) {
+	result := AutobaudResult{}
+
+	if len(baudRates) == 0 {
+		return result, errors.New("no baudrates to try")
+	}
+
+	var expect *regexp.Regexp
+	if options.Expect != "" {
+		var err error
+		expect, err = regexp.Compile(options.Expect)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	probe := []byte(parsePacketSeparator(options.Probe))
+
+	listen := time.Duration(options.Listen) * time.Millisecond
+	if listen <= 0 {
+		listen = defaultAutobaudListen
+	}
+
+	best := -1
+	for _, baudRate := range baudRates {
+		score := AutobaudScore{BaudRate: baudRate}
+
+		received, framingErrors, err := sampleBaudRate(ttyName, portConfig, baudRate, probe, listen, logger)
+		var busy *PortBusyError
+		if errors.As(err, &busy) {
+			return result, err
+		}
+		if err != nil {
+			logger("autobaud", LogWarning, ttyName+" at "+strconv.Itoa(baudRate)+": "+err.Error())
+		} else {
+			score.FramingErrors = framingErrors
+			scoreAutobaud(&score, received, expect)
+		}
+
+		result.Scores = append(result.Scores, score)
+		if best < 0 || score.Score > result.Scores[best].Score {
+			best = len(result.Scores) - 1
+		}
+
+		if score.Matched {
+			// A reply to the probe is as good as it gets
+			break
+		}
+	}
+
+	if result.Scores[best].Score <= 0 {
+		return result, errors.New("no usable traffic received at any baudrate")
+	}
+
+	result.BaudRate = result.Scores[best].BaudRate
+	return result, nil
+}
+
+// sampleBaudRate : open a tty at one baud rate, send the probe and collect what comes back
+func sampleBaudRate(ttyName string, portConfig PortConfig, baudRate int, probe []byte, listen time.Duration, logger Logger) ([]byte, int, error) {
+	portConfig.BaudRate = baudRate
+	// Errors and BREAKs are what tells a wrong rate apart
+	portConfig.DetectBreak = true
+	portConfig.HardwareFlowControl = false
+	portConfig.SoftwareFlowControl = false
+
+	serialPort, err := openSerialPort(ttyName, portConfig, logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer serialPort.Close()
+
+	if len(probe) > 0 {
+		_, err = serialPort.Write(probe)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var received []byte
+	decoder := &parmrkDecoder{}
+	buffer := make([]byte, 256)
+	items := make([]serialItem, 0, 256)
+
+	deadline := time.Now().Add(listen)
+	for time.Now().Before(deadline) {
+		n, err := serialPort.Read(buffer)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		items = decoder.decode(buffer[:n], items[:0])
+		for _, item := range items {
+			if item.isBreak {
+				// At a too high rate, a long low level looks like a BREAK
+				decoder.errors++
+				continue
+			}
+			received = append(received, item.b)
+		}
+	}
+
+	return received, decoder.errors, nil
+}
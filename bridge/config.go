@@ -0,0 +1,126 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"reflect"
+)
+
+// PortConfig : structure holding a port configuration parameters
+type PortConfig struct {
+	Name            string `json:"name"`
+	BaudRate        int    `json:"baudrate"`
+	DataBits        int    `json:"databits"`
+	StopBits        int    `json:"stopbits"`
+	PacketSeparator string `json:"packetSeparator"`
+	UDPInputIP      string `json:"udpInputIP"`
+	UDPInputPort    int    `json:"udpInputPort"`
+	UDPOutputIP     string `json:"udpOutputIP"`
+	UDPOutputPort   int    `json:"udpOutputPort"`
+
+	HardwareFlowControl bool `json:"hardwareFlowControl"`
+	SoftwareFlowControl bool `json:"softwareFlowControl"`
+
+	RS485 RS485Config `json:"rs485"`
+
+	// destination of out-of-band events (line changes...), disabled when the port is 0
+	ControlOutputIP   string `json:"controlOutputIP"`
+	ControlOutputPort int    `json:"controlOutputPort"`
+
+	// UDP datagram that makes us send a BREAK instead of writing it, disabled when empty
+	BreakMessage string `json:"breakMessage"`
+	// duration of the BREAKs sent because of BreakMessage, in milliseconds
+	BreakDuration int `json:"breakDuration"`
+	// report received BREAKs, and send BreakMarker to the UDP output when not empty
+	DetectBreak bool   `json:"detectBreak"`
+	BreakMarker string `json:"breakMarker"`
+
+	Autobaud AutobaudConfig `json:"autobaud"`
+}
+
+// RS485Config : structure holding the RS485 half-duplex parameters of a port
+type RS485Config struct {
+	Enabled bool `json:"enabled"`
+	// RTS is asserted while sending and released afterwards, unless inverted
+	InvertRTS bool `json:"invertRTS"`
+	// delays around a transmission, in milliseconds
+	DelayBeforeSend int `json:"delayBeforeSend"`
+	DelayAfterSend  int `json:"delayAfterSend"`
+	// drop our own transmission when the transceiver echoes it back
+	SuppressEcho bool `json:"suppressEcho"`
+}
+
+// ConfigVersion : version of the configuration format, increased whenever a change to the
+// format needs older configurations to be migrated
+const ConfigVersion = 1
+
+// Config : structure holding the service configuration parameters
+type Config struct {
+	// format of the configuration, 0 for configurations written before versioning
+	Version int          `json:"version"`
+	Ports   []PortConfig `json:"ports"`
+}
+
+// Port : the configuration of a port
+func (config Config) Port(portname string) (PortConfig, error) {
+	for _, portConfig := range config.Ports {
+		if portConfig.Name == portname {
+			return portConfig, nil
+		}
+	}
+	return PortConfig{}, errors.New("no such port " + portname + " in configuration file")
+}
+
+// ConfigDiff : names of the ports affected by replacing a configuration with another one
+type ConfigDiff struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// DiffConfig : compare two configurations port by port
+func DiffConfig(before Config, after Config) ConfigDiff {
+	diff := ConfigDiff{
+		Added:     []string{},
+		Removed:   []string{},
+		Changed:   []string{},
+		Unchanged: []string{},
+	}
+
+	for _, portConfig := range before.Ports {
+		if _, err := after.Port(portConfig.Name); err != nil {
+			diff.Removed = append(diff.Removed, portConfig.Name)
+		}
+	}
+	for _, portConfig := range after.Ports {
+		previous, err := before.Port(portConfig.Name)
+		if err != nil {
+			diff.Added = append(diff.Added, portConfig.Name)
+		} else if !reflect.DeepEqual(previous, portConfig) {
+			diff.Changed = append(diff.Changed, portConfig.Name)
+		} else {
+			diff.Unchanged = append(diff.Unchanged, portConfig.Name)
+		}
+	}
+
+	return diff
+}
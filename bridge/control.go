@@ -0,0 +1,86 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ControlEvent : out-of-band event about a port, sent to its control address
+type ControlEvent struct {
+	Port    string      `json:"port"`
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Lines   *ModemLines `json:"lines,omitempty"`
+	Changed []string    `json:"changed,omitempty"`
+}
+
+// controlSender : sends control events as JSON datagrams, does nothing when no control address is configured
+type controlSender struct {
+	portName   string
+	connection net.Conn
+}
+
+func openControlSender(portConfig PortConfig) (*controlSender, error) {
+	sender := &controlSender{portName: portConfig.Name}
+
+	if portConfig.ControlOutputPort == 0 {
+		return sender, nil
+	}
+
+	ip := portConfig.ControlOutputIP
+	if ip == "" {
+		ip = portConfig.UDPOutputIP
+	}
+
+	connection, err := net.Dial("udp", ip+":"+strconv.Itoa(portConfig.ControlOutputPort))
+	if err != nil {
+		return nil, err
+	}
+	sender.connection = connection
+
+	return sender, nil
+}
+
+func (sender *controlSender) send(event ControlEvent) {
+	if sender.connection == nil {
+		return
+	}
+
+	event.Port = sender.portName
+	event.Time = time.Now()
+
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Events are best effort, like the data stream
+	sender.connection.Write(bytes)
+}
+
+func (sender *controlSender) close() {
+	if sender.connection != nil {
+		sender.connection.Close()
+	}
+}
@@ -0,0 +1,206 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+// PortDefinition : structure that contains information about the mapping of a port name to a tty
+type PortDefinition struct {
+	PortName string `json:"name"`
+	TTY      string `json:"tty,omitempty"`
+	// alternative to TTY, resolved against the devices present when the port starts
+	Match *DeviceMatch `json:"match,omitempty"`
+}
+
+// DeviceMatch : identifies a serial device by its USB identity and/or physical location,
+// every criterion that is set must match
+type DeviceMatch struct {
+	VendorID  string `json:"vendorId,omitempty"`
+	ProductID string `json:"productId,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+	// link name (or full path) under /dev/serial/by-path
+	ByPath string `json:"byPath,omitempty"`
+}
+
+// Definitions : structure that represents the definitions file data
+type Definitions struct {
+	PortDefinitions []PortDefinition `json:"ports"`
+	BaudRates       []int            `json:"baudrates"`
+	// when set, ports may also use baudrates that are not in BaudRates
+	AllowCustomBaudRates bool `json:"allowCustomBaudrates"`
+}
+
+// copyDefinitions : copy definitions so that the copy can be changed without touching the original
+func copyDefinitions(definitions Definitions) Definitions {
+	result := Definitions{
+		PortDefinitions:      append([]PortDefinition{}, definitions.PortDefinitions...),
+		BaudRates:            append([]int{}, definitions.BaudRates...),
+		AllowCustomBaudRates: definitions.AllowCustomBaudRates,
+	}
+	return result
+}
+
+// Find : index of the definition of a port
+func (definitions *Definitions) Find(portName string) (int, bool) {
+	for i, portDefinition := range definitions.PortDefinitions {
+		if portDefinition.PortName == portName {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// Validate : check that a port definition is usable
+func (portDefinition PortDefinition) Validate() error {
+	if portDefinition.PortName == "" {
+		return errors.New("port name is empty")
+	}
+
+	if (portDefinition.TTY == "") == (portDefinition.Match == nil) {
+		return errors.New("port " + portDefinition.PortName + " must have exactly one of tty and match")
+	}
+
+	if portDefinition.Match != nil {
+		match := portDefinition.Match
+		if *match == (DeviceMatch{}) {
+			return errors.New("port " + portDefinition.PortName + " has an empty match")
+		}
+		for _, id := range []string{match.VendorID, match.ProductID} {
+			if id == "" {
+				continue
+			}
+			if _, err := strconv.ParseUint(id, 16, 16); err != nil || len(id) != 4 {
+				return errors.New("port " + portDefinition.PortName + " has an invalid USB id " + id + ", expected 4 hex digits")
+			}
+		}
+		if match.Interface != nil && (*match.Interface < 0 || *match.Interface > 255) {
+			return errors.New("port " + portDefinition.PortName + " has an invalid USB interface number")
+		}
+	}
+
+	return nil
+}
+
+// Validate : check the port definitions and the baudrates
+func (definitions Definitions) Validate() error {
+	names := make(map[string]bool)
+	for _, portDefinition := range definitions.PortDefinitions {
+		err := portDefinition.Validate()
+		if err != nil {
+			return err
+		}
+		if names[portDefinition.PortName] {
+			return errors.New("port name " + portDefinition.PortName + " is defined more than once")
+		}
+		names[portDefinition.PortName] = true
+	}
+
+	baudRates := make(map[int]bool)
+	for _, baudRate := range definitions.BaudRates {
+		if baudRate <= 0 {
+			return errors.New("invalid baudrate " + strconv.Itoa(baudRate))
+		}
+		if baudRates[baudRate] {
+			return errors.New("baudrate " + strconv.Itoa(baudRate) + " is listed more than once")
+		}
+		baudRates[baudRate] = true
+	}
+
+	return nil
+}
+
+// CheckBaudRate : check that a baudrate can be used by a port according to the definitions
+func (definitions Definitions) CheckBaudRate(baudRate int) error {
+	if baudRate <= 0 {
+		return errors.New("invalid baudrate " + strconv.Itoa(baudRate))
+	}
+	if definitions.AllowCustomBaudRates {
+		return nil
+	}
+	for _, allowed := range definitions.BaudRates {
+		if allowed == baudRate {
+			return nil
+		}
+	}
+	return errors.New("baudrate " + strconv.Itoa(baudRate) + " is not in the definitions and custom baudrates are not allowed")
+}
+
+// ChangedPortDefinitions : names of the ports whose definition differs between two sets of definitions
+func ChangedPortDefinitions(before Definitions, after Definitions) []string {
+	var changed []string
+
+	for _, portDefinition := range before.PortDefinitions {
+		i, found := after.Find(portDefinition.PortName)
+		if !found || !reflect.DeepEqual(portDefinition, after.PortDefinitions[i]) {
+			changed = append(changed, portDefinition.PortName)
+		}
+	}
+	for _, portDefinition := range after.PortDefinitions {
+		if _, found := before.Find(portDefinition.PortName); !found {
+			changed = append(changed, portDefinition.PortName)
+		}
+	}
+
+	return changed
+}
+
+// errDeviceNotFound : the definition exists but no device currently matches it
+var errDeviceNotFound = errors.New("no device matches the port definition")
+
+func getPortTTY(definitions Definitions, portname string, logger Logger) (string, error) {
+	for _, portDefinition := range definitions.PortDefinitions {
+		if portDefinition.PortName == portname {
+			return resolvePortDefinition(portDefinition, logger)
+		}
+	}
+
+	return "", errors.New("no such port name " + portname + " in definitions file")
+}
+
+// resolvePortDefinition : find the tty a definition currently refers to
+func resolvePortDefinition(portDefinition PortDefinition, logger Logger) (string, error) {
+	if portDefinition.Match == nil {
+		return portDefinition.TTY, nil
+	}
+	if *portDefinition.Match == (DeviceMatch{}) {
+		return "", errors.New("empty device match for port name " + portDefinition.PortName)
+	}
+
+	var found []SerialDevice
+	for _, device := range ListSerialDevices() {
+		if portDefinition.Match.matches(device) {
+			found = append(found, device)
+		}
+	}
+
+	if len(found) == 0 {
+		return "", errDeviceNotFound
+	}
+	if len(found) > 1 {
+		logger("definitions", LogWarning, portDefinition.PortName+" matches "+strconv.Itoa(len(found))+" devices, using "+found[0].TTY)
+	}
+
+	return found[0].TTY, nil
+}
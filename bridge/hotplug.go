@@ -0,0 +1,73 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const sysfsTTYClass = "/sys/class/tty"
+
+// DevicePresent : tell whether a tty exists, both as a device node and in sysfs
+func DevicePresent(ttyName string) bool {
+	path, err := filepath.EvalSymlinks(ttyName)
+	if err != nil {
+		return false
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+
+	// Without sysfs the device node is all we can check, and pseudo terminals are not listed there
+	if _, err := os.Stat(sysfsTTYClass); err != nil || strings.HasPrefix(path, "/dev/pts/") {
+		return true
+	}
+
+	_, err = os.Stat(filepath.Join(sysfsTTYClass, filepath.Base(path)))
+	return err == nil
+}
+
+// waitForDevice : block until a device appears, returns false if stopped before that
+func waitForDevice(present func() bool, stop <-chan struct{}) bool {
+	events, closeWatcher, err := watchDevices()
+	if err != nil {
+		// Polling alone will do
+		events = nil
+	} else {
+		defer closeWatcher()
+	}
+
+	for {
+		if present() {
+			return true
+		}
+
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+		case <-stop:
+			return false
+		}
+	}
+}
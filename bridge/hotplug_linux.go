@@ -0,0 +1,60 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDevices : get notified when device nodes are created or removed in /dev
+func watchDevices() (<-chan struct{}, func(), error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = unix.InotifyAddWatch(fd, "/dev", unix.IN_CREATE|unix.IN_DELETE|unix.IN_ATTRIB)
+	if err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+
+	// Non-blocking, so that the runtime poller lets Close interrupt a pending Read
+	file := os.NewFile(uintptr(fd), "inotify")
+	events := make(chan struct{}, 1)
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			_, err := file.Read(buffer)
+			if err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return events, func() { file.Close() }, nil
+}
@@ -0,0 +1,253 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bridge bridges serial ports over UDP packets.
+//
+// A Manager owns a set of ports described by a Config, resolves their ttys
+// through Definitions and keeps their statistics. Several managers can run in
+// the same process, as long as they do not share ttys or UDP sockets.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log level constants
+const (
+	LogInfo    = 4
+	LogWarning = 3
+	LogError   = 2
+)
+
+// Logger : receives the log messages of a manager, source is the component or port thread
+// the message comes from
+type Logger func(source string, level int, content interface{})
+
+// Options : optional parameters of a manager
+type Options struct {
+	// where log messages go, discarded when nil
+	Logger Logger
+	// persists definitions changed through UpdateDefinitions, the change is
+	// refused when it fails; changes are kept in memory only when nil
+	SaveDefinitions func(definitions Definitions) error
+	// how long shutdown waits for the ports to stop, and stopping a single port
+	// waits for it; 5 seconds when zero
+	ShutdownTimeout time.Duration
+}
+
+// supervisorHeartbeatInterval : how often the supervisor loop proves it is alive
+const supervisorHeartbeatInterval = time.Second
+
+// Manager : runs the ports of a configuration and keeps their statistics
+type Manager struct {
+	// UnixNano time of the last supervisor loop iteration, accessed atomically
+	heartbeat int64
+
+	logger          Logger
+	saveDefinitions func(definitions Definitions) error
+	shutdownTimeout time.Duration
+
+	config      Config
+	configMutex sync.Mutex
+
+	// never modified in place, replaced as a whole
+	definitions      Definitions
+	definitionsMutex sync.Mutex
+
+	statistics statistics
+
+	// parent of the contexts of all the port threads, set by Run
+	ctx          context.Context
+	stopChannel  chan *portThread
+	threads      map[string]*portThread
+	threadsMutex sync.Mutex
+	// threads that have not reported on stopChannel yet, guarded by threadsMutex
+	liveThreads int
+
+	handles      map[string]*portHandle
+	handlesMutex sync.Mutex
+
+	// serializes configuration applies
+	applyMutex sync.Mutex
+}
+
+// NewManager : create a manager for a configuration, ports are started by Run
+func NewManager(definitions Definitions, config Config, options Options) *Manager {
+	logger := options.Logger
+	if logger == nil {
+		logger = func(string, int, interface{}) {}
+	}
+	timeout := options.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = shutdownTimeout
+	}
+
+	m := &Manager{
+		logger:          logger,
+		saveDefinitions: options.SaveDefinitions,
+		shutdownTimeout: timeout,
+		config:          config,
+		definitions:     definitions,
+		stopChannel:     make(chan *portThread),
+		threads:         make(map[string]*portThread),
+		handles:         make(map[string]*portHandle),
+	}
+	m.statistics.ports = make(map[string]*portStatistics)
+
+	return m
+}
+
+// Run : start every configured port and supervise them until the context is cancelled,
+// returns once the ports are stopped
+func (m *Manager) Run(ctx context.Context) {
+	var waitGroup sync.WaitGroup
+
+	waitGroup.Add(1)
+	go m.startAndSuperviseThreads(ctx, &waitGroup)
+
+	waitGroup.Add(1)
+	go m.statisticsThread(ctx, &waitGroup)
+
+	waitGroup.Wait()
+}
+
+// Healthy : whether the supervisor loop is running and not stuck
+func (m *Manager) Healthy() bool {
+	last := time.Unix(0, atomic.LoadInt64(&m.heartbeat))
+	return time.Since(last) < 3*supervisorHeartbeatInterval
+}
+
+// Config : the running configuration
+func (m *Manager) Config() Config {
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	return m.config
+}
+
+func (m *Manager) setConfig(config Config) {
+	m.configMutex.Lock()
+	m.config = config
+	m.configMutex.Unlock()
+}
+
+// Definitions : the definitions the ports are resolved with
+func (m *Manager) Definitions() Definitions {
+	m.definitionsMutex.Lock()
+	defer m.definitionsMutex.Unlock()
+	return m.definitions
+}
+
+// UpdateDefinitions : apply a change to the definitions, validate and save them, then
+// restart the running ports whose definition changed;
+// returns the definitions as they were before the change
+func (m *Manager) UpdateDefinitions(change func(definitions *Definitions) error) (Definitions, error) {
+	m.definitionsMutex.Lock()
+
+	changed := copyDefinitions(m.definitions)
+
+	err := change(&changed)
+	if err == nil {
+		err = changed.Validate()
+	}
+	if err == nil && m.saveDefinitions != nil {
+		err = m.saveDefinitions(changed)
+	}
+	if err != nil {
+		m.definitionsMutex.Unlock()
+		return Definitions{}, err
+	}
+
+	previous := m.definitions
+	m.definitions = changed
+	m.definitionsMutex.Unlock()
+
+	for _, portName := range ChangedPortDefinitions(previous, changed) {
+		if _, err := m.Config().Port(portName); err == nil {
+			m.restartThread(portName)
+		}
+	}
+
+	return previous, nil
+}
+
+// Reload : replace both the configuration and the definitions, restarting only the
+// ports affected by the changes
+func (m *Manager) Reload(config Config, definitions Definitions) (ConfigDiff, error) {
+	err := definitions.Validate()
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+
+	m.definitionsMutex.Lock()
+	previous := m.definitions
+	m.definitions = definitions
+	m.definitionsMutex.Unlock()
+
+	diff := m.Apply(config)
+
+	// Ports restarted by the apply already use the new definitions
+	for _, portName := range ChangedPortDefinitions(previous, definitions) {
+		for _, unchanged := range diff.Unchanged {
+			if unchanged == portName {
+				m.restartThread(portName)
+			}
+		}
+	}
+
+	return diff, nil
+}
+
+// Port : a port of the running configuration
+func (m *Manager) Port(portName string) (*Port, error) {
+	if _, err := m.Config().Port(portName); err != nil {
+		return nil, err
+	}
+	return &Port{m, portName}, nil
+}
+
+// Ports : the ports of the running configuration
+func (m *Manager) Ports() []*Port {
+	var ports []*Port
+	for _, portConfig := range m.Config().Ports {
+		ports = append(ports, &Port{m, portConfig.Name})
+	}
+	return ports
+}
+
+// Statistics : statistics of every port
+func (m *Manager) Statistics() PublicStatistics {
+	return m.statistics.public()
+}
+
+// ResolvePortDefinition : find the tty a definition currently refers to
+func (m *Manager) ResolvePortDefinition(portDefinition PortDefinition) (string, error) {
+	return resolvePortDefinition(portDefinition, m.logger)
+}
+
+// ClaimedDevices : map every tty that a definition currently resolves to, to the definition port name
+func (m *Manager) ClaimedDevices() map[string]string {
+	return claimedDevices(m.Definitions(), m.logger)
+}
+
+// errNotRunning : the manager has not been started, or has been shut down
+var errNotRunning = errors.New("the manager is not running")
@@ -0,0 +1,381 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty : open a pseudo terminal, returns its master side and the name of the tty a port uses
+func openPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals: " + err.Error())
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	number, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, "/dev/pts/" + strconv.Itoa(number)
+}
+
+// freeUDPPort : a local UDP port nobody listens on right now
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// testPort : a configured port bridged to a pseudo terminal
+type testPort struct {
+	config PortConfig
+	master *os.File
+	// receives what the port sends over UDP
+	output *net.UDPConn
+}
+
+// send : keep sending packets to the UDP input of the port until the context is cancelled
+func (port testPort) send(ctx context.Context, size int) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port.config.UDPInputPort})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	packet := make([]byte, size)
+	for ctx.Err() == nil {
+		conn.Write(packet)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTestManager : a manager for ports named after prefix, one pseudo terminal each
+func newTestManager(t *testing.T, prefix string, count int, options Options) (*Manager, []testPort) {
+	t.Helper()
+
+	var definitions = Definitions{BaudRates: []int{9600, 115200}}
+	var config = Config{Version: ConfigVersion}
+	var ports []testPort
+	for i := 0; i < count; i++ {
+		master, ttyName := openPty(t)
+		output, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { output.Close() })
+
+		name := prefix + strconv.Itoa(i+1)
+		portConfig := PortConfig{
+			Name:          name,
+			BaudRate:      9600,
+			DataBits:      8,
+			StopBits:      1,
+			UDPInputIP:    "127.0.0.1",
+			UDPInputPort:  freeUDPPort(t),
+			UDPOutputIP:   "127.0.0.1",
+			UDPOutputPort: output.LocalAddr().(*net.UDPAddr).Port,
+		}
+		definitions.PortDefinitions = append(definitions.PortDefinitions, PortDefinition{PortName: name, TTY: ttyName})
+		config.Ports = append(config.Ports, portConfig)
+		ports = append(ports, testPort{portConfig, master, output})
+	}
+
+	return NewManager(definitions, config, options), ports
+}
+
+// runManager : run a manager until the test ends, the returned channel is closed when Run returns
+func runManager(t *testing.T, m *Manager) (context.CancelFunc, <-chan struct{}) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return cancel, stopped
+}
+
+// waitForState : wait until a port reaches a state, fails the test after a while
+func waitForState(t *testing.T, m *Manager, portName string, state string) {
+	t.Helper()
+
+	port, err := m.Port(portName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if port.Status().State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("port %s is %s, not %s", portName, port.Status().State, state)
+}
+
+// Traffic, statistics and status are read while ports are paused, restarted and
+// reconfigured; meant to be run with -race
+func TestManagerConcurrentControl(t *testing.T) {
+	m, ports := newTestManager(t, "P", 2, Options{})
+	runManager(t, m)
+	for _, port := range ports {
+		waitForState(t, m, port.config.Name, PortStateRunning)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for _, port := range ports {
+		port := port
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			port.send(ctx, 64)
+		}()
+		go func() {
+			// Reads what the port writes, and answers so that there is traffic both ways
+			defer wg.Done()
+			buffer := make([]byte, 4096)
+			for ctx.Err() == nil {
+				n, err := port.master.Read(buffer)
+				if err != nil {
+					return
+				}
+				port.master.Write(buffer[:n])
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, 4096)
+			for ctx.Err() == nil {
+				port.output.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				port.output.Read(buffer)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			m.Statistics()
+			for _, port := range m.Ports() {
+				port.Status()
+				port.Statistics()
+				port.Config()
+			}
+			m.Config()
+			m.Healthy()
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		port, err := m.Port("P1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := port.Pause(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := port.Resume(); err != nil {
+			t.Fatal(err)
+		}
+		if err := port.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		waitForState(t, m, "P1", PortStateRunning)
+
+		config := m.Config()
+		config.Ports = append([]PortConfig{}, config.Ports...)
+		if config.Ports[1].BaudRate == 9600 {
+			config.Ports[1].BaudRate = 115200
+		} else {
+			config.Ports[1].BaudRate = 9600
+		}
+		diff := m.Apply(config)
+		if len(diff.Changed) != 1 || diff.Changed[0] != "P2" {
+			t.Fatalf("apply changed %v, expected P2", diff.Changed)
+		}
+		waitForState(t, m, "P2", PortStateRunning)
+	}
+
+	stats := m.Statistics()
+	for _, port := range ports {
+		if stats.Ports[port.config.Name].UDP2SerialBytes == 0 {
+			t.Errorf("no traffic went through %s", port.config.Name)
+		}
+	}
+}
+
+// A port whose tty nobody reads stops anyway, dropping the write held back by flow control
+func TestPortStopWithHeldWrite(t *testing.T) {
+	m, ports := newTestManager(t, "P", 1, Options{})
+	runManager(t, m)
+	waitForState(t, m, "P1", PortStateRunning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ports[0].send(ctx, 4000)
+
+	// Until the pseudo terminal buffer is full
+	time.Sleep(time.Second)
+
+	port, err := m.Port("P1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := port.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > m.shutdownTimeout {
+		t.Errorf("stop took %v", elapsed)
+	}
+	if state := port.Status().State; state != PortStateStopped {
+		t.Errorf("port is %s after stop", state)
+	}
+}
+
+// A thread still busy when shutdown gives up on it ends later on its own, without
+// holding up another manager
+func TestShutdownTimeoutCollectsLateThreads(t *testing.T) {
+	stuck, stuckPorts := newTestManager(t, "A", 1, Options{ShutdownTimeout: 200 * time.Millisecond})
+	cancelStuck, stuckStopped := runManager(t, stuck)
+	other, otherPorts := newTestManager(t, "B", 1, Options{})
+	runManager(t, other)
+	waitForState(t, stuck, "A1", PortStateRunning)
+	waitForState(t, other, "B1", PortStateRunning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Nobody reads the tty of A1, its stop has to wait for the drain timeout
+	go stuckPorts[0].send(ctx, 4000)
+	time.Sleep(time.Second)
+
+	stuck.threadsMutex.Lock()
+	thread := stuck.threads["A1"]
+	stuck.threadsMutex.Unlock()
+
+	cancelStuck()
+	select {
+	case <-stuckStopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the shutdown timeout")
+	}
+
+	select {
+	case <-thread.done:
+	case <-time.After(2 * drainTimeout):
+		t.Fatal("the thread of A1 never ended")
+	}
+	stuck.threadsMutex.Lock()
+	live := stuck.liveThreads
+	stuck.threadsMutex.Unlock()
+	if live != 0 {
+		t.Errorf("%d threads still running", live)
+	}
+
+	// The other manager kept working all along
+	before := other.Statistics().Ports["B1"].UDP2SerialBytes
+	go otherPorts[0].send(ctx, 16)
+	go func() {
+		buffer := make([]byte, 4096)
+		for ctx.Err() == nil {
+			if _, err := otherPorts[0].master.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if after := other.Statistics().Ports["B1"].UDP2SerialBytes; after == before {
+		t.Error("no traffic went through B1")
+	}
+}
+
+// Two ports of one process on the same tty, here from two managers: the second one is busy
+// until the first one lets the tty go, and does not take its lock file away
+func TestSameTTYInOneProcess(t *testing.T) {
+	first, _ := newTestManager(t, "A", 1, Options{})
+	ttyName := first.Definitions().PortDefinitions[0].TTY
+
+	portConfig := first.Config().Ports[0]
+	portConfig.Name = "B1"
+	portConfig.UDPInputPort = freeUDPPort(t)
+	second := NewManager(
+		Definitions{PortDefinitions: []PortDefinition{{PortName: "B1", TTY: ttyName}}, BaudRates: []int{9600}},
+		Config{Version: ConfigVersion, Ports: []PortConfig{portConfig}},
+		Options{},
+	)
+
+	runManager(t, first)
+	waitForState(t, first, "A1", PortStateRunning)
+	runManager(t, second)
+	waitForState(t, second, "B1", PortStateBusy)
+
+	lockFile := filepath.Join(uucpLockDir, "LCK.."+filepath.Base(ttyName))
+	if _, err := os.Stat(uucpLockDir); err == nil {
+		if pid := readLockPID(lockFile); pid != os.Getpid() {
+			t.Errorf("lock file of %s holds PID %d", ttyName, pid)
+		}
+	}
+
+	port, err := first.Port("A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := port.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := second.Port("B1"); err == nil {
+		port.Start()
+	}
+	waitForState(t, second, "B1", PortStateRunning)
+}
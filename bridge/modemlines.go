@@ -0,0 +1,82 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"strings"
+)
+
+// ModemLines : state of the modem control lines of a serial port
+type ModemLines struct {
+	CTS bool `json:"cts"`
+	DSR bool `json:"dsr"`
+	DCD bool `json:"dcd"`
+	RI  bool `json:"ri"`
+	DTR bool `json:"dtr"`
+	RTS bool `json:"rts"`
+}
+
+// ModemLinesUpdate : requested change of the output modem control lines, nil fields are left untouched
+type ModemLinesUpdate struct {
+	DTR *bool `json:"dtr"`
+	RTS *bool `json:"rts"`
+}
+
+// changedLines : names of the lines that differ between two states
+func changedLines(before ModemLines, after ModemLines) []string {
+	var changed []string
+	if before.CTS != after.CTS {
+		changed = append(changed, "cts")
+	}
+	if before.DSR != after.DSR {
+		changed = append(changed, "dsr")
+	}
+	if before.DCD != after.DCD {
+		changed = append(changed, "dcd")
+	}
+	if before.RI != after.RI {
+		changed = append(changed, "ri")
+	}
+	if before.DTR != after.DTR {
+		changed = append(changed, "dtr")
+	}
+	if before.RTS != after.RTS {
+		changed = append(changed, "rts")
+	}
+	return changed
+}
+
+func (lines ModemLines) String() string {
+	var result []string
+	for _, line := range []struct {
+		name  string
+		level bool
+	}{
+		{"CTS", lines.CTS}, {"DSR", lines.DSR}, {"DCD", lines.DCD},
+		{"RI", lines.RI}, {"DTR", lines.DTR}, {"RTS", lines.RTS},
+	} {
+		if line.level {
+			result = append(result, line.name+"=1")
+		} else {
+			result = append(result, line.name+"=0")
+		}
+	}
+	return strings.Join(result, " ")
+}
@@ -0,0 +1,160 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"time"
+)
+
+// Port : a port of the configuration run by a manager
+type Port struct {
+	manager *Manager
+	name    string
+}
+
+// PortNotRunningError : the operation needs the serial port of the port to be open
+type PortNotRunningError struct {
+	Port string
+}
+
+func (err *PortNotRunningError) Error() string {
+	return "port " + err.Port + " is not running"
+}
+
+// Name : name of the port, as in the configuration and the definitions
+func (port *Port) Name() string {
+	return port.name
+}
+
+// Config : the running configuration of the port
+func (port *Port) Config() (PortConfig, error) {
+	return port.manager.Config().Port(port.name)
+}
+
+// Start : start a port that is not running, or that is waiting to be restarted after a failure
+func (port *Port) Start() error {
+	return port.manager.startThread(port.name)
+}
+
+// Stop : stop the port and wait for it, it stays stopped until started again
+func (port *Port) Stop() error {
+	return port.manager.stopThread(port.name)
+}
+
+// Restart : restart the port with the current configuration and definitions,
+// a stopped port is simply started
+func (port *Port) Restart() error {
+	if port.manager.restartThread(port.name) != nil {
+		return port.manager.startThread(port.name)
+	}
+	return nil
+}
+
+// Pause : stop forwarding traffic, keeping the serial port and the sockets open
+func (port *Port) Pause() error {
+	return port.manager.pauseThread(port.name, true)
+}
+
+// Resume : forward traffic again after Pause
+func (port *Port) Resume() error {
+	return port.manager.pauseThread(port.name, false)
+}
+
+// Status : state machine of the port
+func (port *Port) Status() PortStatus {
+	return port.manager.getPortStatistics(port.name).State.status(port.name)
+}
+
+// Statistics : traffic statistics of the port
+func (port *Port) Statistics() PublicPortStatistics {
+	return port.manager.getPortStatistics(port.name).public(port.name, time.Now())
+}
+
+// Lines : state of the modem control lines
+func (port *Port) Lines() (ModemLines, error) {
+	handle, err := port.manager.getPortHandle(port.name)
+	if err != nil {
+		return ModemLines{}, err
+	}
+	return getModemLines(handle.serialPort)
+}
+
+// SetLines : change the output modem control lines, returns the resulting state of all the lines
+func (port *Port) SetLines(update ModemLinesUpdate) (ModemLines, error) {
+	handle, err := port.manager.getPortHandle(port.name)
+	if err != nil {
+		return ModemLines{}, err
+	}
+
+	err = setModemLines(handle.serialPort, update)
+	if err != nil {
+		return ModemLines{}, err
+	}
+	return getModemLines(handle.serialPort)
+}
+
+// SendBreak : transmit a BREAK between two writes, of the default duration when zero
+func (port *Port) SendBreak(duration time.Duration) error {
+	handle, err := port.manager.getPortHandle(port.name)
+	if err != nil {
+		return err
+	}
+	return handle.requestBreak(duration)
+}
+
+// DetectBaudRate : detect the baud rate of the device, the port goes back to the configured one
+// afterwards; SetBaudRate switches to the detected rate
+func (port *Port) DetectBaudRate(options AutobaudConfig) (AutobaudResult, error) {
+	handle, err := port.manager.getPortHandle(port.name)
+	if err != nil {
+		return AutobaudResult{}, err
+	}
+	return handle.requestAutobaud(options)
+}
+
+// SetBaudRate : change the baud rate of the port in the running configuration, the port
+// restarts with it as with any other applied change
+func (port *Port) SetBaudRate(baudRate int) error {
+	if err := port.manager.Definitions().CheckBaudRate(baudRate); err != nil {
+		return err
+	}
+
+	m := port.manager
+	m.applyMutex.Lock()
+	defer m.applyMutex.Unlock()
+
+	config := m.Config()
+	// Readers share the old slice, never change it in place
+	config.Ports = append([]PortConfig{}, config.Ports...)
+	found := false
+	for i := range config.Ports {
+		if config.Ports[i].Name == port.name {
+			config.Ports[i].BaudRate = baudRate
+			found = true
+		}
+	}
+	if !found {
+		_, err := config.Port(port.name)
+		return err
+	}
+
+	m.apply(config)
+	return nil
+}
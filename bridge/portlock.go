@@ -0,0 +1,234 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uucpLockDir = "/var/lock"
+
+// PortBusyError : the tty is already in use by another process
+type PortBusyError struct {
+	TTY     string
+	PID     int
+	Command string
+}
+
+func (err *PortBusyError) Error() string {
+	if err.PID <= 0 {
+		return err.TTY + " is busy"
+	}
+	if err.Command == "" {
+		return err.TTY + " is busy, held by PID " + strconv.Itoa(err.PID)
+	}
+	return err.TTY + " is busy, held by PID " + strconv.Itoa(err.PID) + " (" + err.Command + ")"
+}
+
+func newPortBusyError(ttyName string, pid int) *PortBusyError {
+	return &PortBusyError{ttyName, pid, processCommand(pid)}
+}
+
+func processCommand(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	bytes, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes))
+}
+
+// findTTYHolder : look in /proc for another process that has the tty open, returns 0 if none;
+// the ports of this process are kept apart by acquireUUCPLock
+func findTTYHolder(ttyPath string) int {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// Not ours to look at
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && target == ttyPath {
+				return pid
+			}
+		}
+	}
+
+	return 0
+}
+
+// The ttys locked by the ports of this process, whatever manager runs them: the lock files
+// only tell processes apart, and as root TIOCEXCL does not keep a second open out
+var (
+	lockedTTYs      = make(map[string]bool)
+	lockedTTYsMutex sync.Mutex
+)
+
+// uucpLock : a UUCP style LCK..<tty> lock file, as used by minicom, pppd and friends
+type uucpLock struct {
+	ttyPath string
+	// empty when the lock directory is not usable
+	path string
+}
+
+// acquireUUCPLock : create the lock file of a tty, failing with PortBusyError if a live process or
+// another port of ours owns it; without a usable lock directory only the ports of this process are
+// kept apart, since the lock file is only advisory
+func acquireUUCPLock(ttyPath string, logger Logger) (*uucpLock, error) {
+	lockedTTYsMutex.Lock()
+	defer lockedTTYsMutex.Unlock()
+
+	if lockedTTYs[ttyPath] {
+		return nil, newPortBusyError(ttyPath, os.Getpid())
+	}
+
+	path, err := createLockFile(ttyPath, logger)
+	if err != nil {
+		return nil, err
+	}
+	lockedTTYs[ttyPath] = true
+	return &uucpLock{ttyPath, path}, nil
+}
+
+// createLockFile : create the lock file of a tty that no port of ours holds, returns its path
+func createLockFile(ttyPath string, logger Logger) (string, error) {
+	path := filepath.Join(uucpLockDir, "LCK.."+filepath.Base(ttyPath))
+	content := []byte(padLeft(strconv.Itoa(os.Getpid()), 10) + "\n")
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = file.Write(content)
+			file.Close()
+			if err != nil {
+				os.Remove(path)
+				return "", err
+			}
+			return path, nil
+		}
+
+		if !os.IsExist(err) {
+			logger("lock", LogWarning, "cannot create "+path+": "+err.Error())
+			return "", nil
+		}
+
+		pid := readLockPID(path)
+		if pid == os.Getpid() {
+			// No port of ours holds the tty, so this was left over by one that did not release it
+			return path, nil
+		}
+		if pid > 0 && processAlive(pid) {
+			return "", newPortBusyError(ttyPath, pid)
+		}
+
+		logger("lock", LogInfo, "removing stale lock file "+path)
+		os.Remove(path)
+	}
+
+	return "", &PortBusyError{TTY: ttyPath}
+}
+
+func (lock *uucpLock) release() {
+	if lock == nil {
+		return
+	}
+
+	lockedTTYsMutex.Lock()
+	defer lockedTTYsMutex.Unlock()
+
+	if lock.path != "" && readLockPID(lock.path) == os.Getpid() {
+		os.Remove(lock.path)
+	}
+	delete(lockedTTYs, lock.ttyPath)
+}
+
+// readLockPID : parse the PID from a lock file, either ASCII or binary (old UUCP) format
+func readLockPID(path string) int {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bytes)))
+	if err == nil {
+		return pid
+	}
+
+	if len(bytes) == 4 {
+		return int(bytes[0]) | int(bytes[1])<<8 | int(bytes[2])<<16 | int(bytes[3])<<24
+	}
+
+	return 0
+}
+
+func padLeft(s string, width int) string {
+	for len(s) < width {
+		s = " " + s
+	}
+	return s
+}
+
+// lockedSerialPort : serial port that releases its lock file when closed
+type lockedSerialPort struct {
+	io.ReadWriteCloser
+	lock      *uucpLock
+	closeOnce sync.Once
+}
+
+func (port *lockedSerialPort) Close() error {
+	err := port.ReadWriteCloser.Close()
+	port.closeOnce.Do(port.lock.release)
+	return err
+}
+
+func (port *lockedSerialPort) Fd() uintptr {
+	if file, ok := port.ReadWriteCloser.(interface{ Fd() uintptr }); ok {
+		return file.Fd()
+	}
+	return ^uintptr(0)
+}
+
+func (port *lockedSerialPort) SetDeadline(t time.Time) error {
+	if file, ok := port.ReadWriteCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return file.SetDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
@@ -0,0 +1,234 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// Port states
+const (
+	// the thread is setting up its sockets and resolving the tty
+	PortStateStarting = "starting"
+	// the tty is not present, the port reopens it when it comes back
+	PortStateWaitingForDevice = "waiting for device"
+	// trying the baudrates before opening the port
+	PortStateDetectingBaudRate = "detecting baudrate"
+	// bridging traffic
+	PortStateRunning = "running"
+	// the tty is open but traffic is dropped on purpose
+	PortStatePaused = "paused"
+	// another process holds the tty
+	PortStateBusy = "busy"
+	// the tty could not be opened, retrying
+	PortStateRetrying = "retrying"
+	// the thread ended with an error, the supervisor restarts it after a backoff
+	PortStateFailed = "failed"
+	// the thread ended on request
+	PortStateStopped = "stopped"
+)
+
+// portStateTransitions : states that can be entered from each state, a function
+// rather than a variable so that the table cannot be changed at run time
+func portStateTransitions(state string) []string {
+	return map[string][]string{
+		"":                         {PortStateStarting},
+		PortStateStarting:          {PortStateWaitingForDevice, PortStateDetectingBaudRate, PortStateRunning, PortStatePaused, PortStateBusy, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStateWaitingForDevice:  {PortStateDetectingBaudRate, PortStateRunning, PortStatePaused, PortStateBusy, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStateDetectingBaudRate: {PortStateWaitingForDevice, PortStateRunning, PortStatePaused, PortStateBusy, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStateRunning:           {PortStateWaitingForDevice, PortStateDetectingBaudRate, PortStatePaused, PortStateBusy, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStatePaused:            {PortStateWaitingForDevice, PortStateDetectingBaudRate, PortStateRunning, PortStateBusy, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStateBusy:              {PortStateWaitingForDevice, PortStateDetectingBaudRate, PortStateRunning, PortStatePaused, PortStateRetrying, PortStateFailed, PortStateStopped},
+		PortStateRetrying:          {PortStateWaitingForDevice, PortStateDetectingBaudRate, PortStateRunning, PortStatePaused, PortStateBusy, PortStateFailed, PortStateStopped},
+		PortStateFailed:            {PortStateStarting, PortStateStopped},
+		PortStateStopped:           {PortStateStarting},
+	}[state]
+}
+
+// maxPortTransitions : how many transitions are kept in the history of a port
+const maxPortTransitions = 20
+
+// Restart backoff of failed ports
+const (
+	restartBackoffMin = 1 * time.Second
+	restartBackoffMax = 1 * time.Minute
+	// a thread that ran longer than this is not considered to be failing repeatedly
+	restartBackoffReset = 5 * time.Minute
+)
+
+// restartBackoff : delay before restarting a port after its n-th consecutive failure
+func restartBackoff(failures int) time.Duration {
+	delay := restartBackoffMin
+	for i := 1; i < failures && delay < restartBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > restartBackoffMax {
+		delay = restartBackoffMax
+	}
+	return delay
+}
+
+// PortTransition : a state change of a port
+type PortTransition struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// PortStatus : snapshot of the state machine of a port
+type PortStatus struct {
+	Name          string           `json:"name"`
+	State         string           `json:"state"`
+	Since         time.Time        `json:"since"`
+	LastError     string           `json:"lastError,omitempty"`
+	LastErrorTime *time.Time       `json:"lastErrorTime,omitempty"`
+	Restarts      int              `json:"restarts"`
+	NextRestart   *time.Time       `json:"nextRestart,omitempty"`
+	Transitions   []PortTransition `json:"transitions"`
+}
+
+// portState : state machine of a port, shared by its thread and the supervisor
+type portState struct {
+	mutex  sync.Mutex
+	logger Logger
+
+	state         string
+	since         time.Time
+	lastError     string
+	lastErrorTime time.Time
+	restarts      int
+	nextRestart   time.Time
+	transitions   []PortTransition
+}
+
+// set : move to a new state, transitions that the state machine does not allow are refused
+func (ps *portState) set(portName string, state string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.enter(portName, state)
+}
+
+// swap : move to a new state only when in the expected one
+func (ps *portState) swap(portName string, expected string, state string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.state != expected {
+		return false
+	}
+	return ps.enter(portName, state)
+}
+
+// enter : state transition, with the mutex held
+func (ps *portState) enter(portName string, state string) bool {
+	if ps.state == state {
+		return true
+	}
+
+	allowed := false
+	for _, next := range portStateTransitions(ps.state) {
+		if next == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		if ps.logger != nil {
+			ps.logger(portName, LogWarning, "refused port state transition from "+ps.state+" to "+state)
+		}
+		return false
+	}
+
+	now := time.Now()
+	transition := PortTransition{From: ps.state, To: state, Time: now}
+	if state == PortStateFailed || state == PortStateBusy || state == PortStateRetrying {
+		transition.Error = ps.lastError
+	}
+	ps.transitions = append(ps.transitions, transition)
+	if len(ps.transitions) > maxPortTransitions {
+		ps.transitions = ps.transitions[len(ps.transitions)-maxPortTransitions:]
+	}
+
+	ps.state = state
+	ps.since = now
+	if state != PortStateFailed {
+		ps.nextRestart = time.Time{}
+	}
+	return true
+}
+
+func (ps *portState) get() string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.state
+}
+
+// setError : record the last error of the port, kept after the port recovers
+func (ps *portState) setError(err error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.lastError = err.Error()
+	ps.lastErrorTime = time.Now()
+}
+
+// scheduleRestart : record when the supervisor is going to restart the port
+func (ps *portState) scheduleRestart(at time.Time) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.nextRestart = at
+}
+
+// restarted : count a restart of the port
+func (ps *portState) restarted() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.restarts++
+	ps.nextRestart = time.Time{}
+}
+
+func (ps *portState) status(portName string) PortStatus {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	status := PortStatus{
+		Name:        portName,
+		State:       ps.state,
+		Since:       ps.since,
+		LastError:   ps.lastError,
+		Restarts:    ps.restarts,
+		Transitions: append([]PortTransition{}, ps.transitions...),
+	}
+	if !ps.lastErrorTime.IsZero() {
+		lastErrorTime := ps.lastErrorTime
+		status.LastErrorTime = &lastErrorTime
+	}
+	if !ps.nextRestart.IsZero() {
+		nextRestart := ps.nextRestart
+		status.NextRestart = &nextRestart
+	}
+	return status
+}
@@ -0,0 +1,80 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// echoFilter : removes from the serial input the bytes we have just transmitted,
+// for half-duplex transceivers that loop the transmitter back into the receiver
+type echoFilter struct {
+	mutex    sync.Mutex
+	pending  []byte
+	deadline time.Time
+	timeout  time.Duration
+}
+
+func newEchoFilter(portConfig PortConfig) *echoFilter {
+	return &echoFilter{timeout: characterTime(portConfig)}
+}
+
+// expect : register data that is about to be written to the port
+func (filter *echoFilter) expect(data []byte) {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	if len(filter.pending) == 0 {
+		filter.deadline = time.Now()
+	}
+	filter.pending = append(filter.pending, data...)
+	// Leave room for the transmission itself plus some scheduling slack
+	filter.deadline = filter.deadline.Add(filter.timeout*time.Duration(len(data)) + 100*time.Millisecond)
+}
+
+// drop : tell whether a byte read from the port is the echo of our own transmission
+func (filter *echoFilter) drop(b byte) bool {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	if len(filter.pending) == 0 {
+		return false
+	}
+
+	if time.Now().After(filter.deadline) || b != filter.pending[0] {
+		// The echo never came back or got corrupted, everything from here is a reply
+		filter.pending = nil
+		return false
+	}
+
+	filter.pending = filter.pending[1:]
+	return true
+}
+
+// characterTime : time needed to transmit one character with the port settings
+func characterTime(portConfig PortConfig) time.Duration {
+	if portConfig.BaudRate <= 0 {
+		return 0
+	}
+	// start bit + data bits + stop bits
+	bits := 1 + portConfig.DataBits + portConfig.StopBits
+	return time.Duration(bits) * time.Second / time.Duration(portConfig.BaudRate)
+}
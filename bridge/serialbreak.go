@@ -0,0 +1,97 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultBreakDuration = 250 * time.Millisecond
+
+// serialItem : one element of the serial input stream, either a data byte or a BREAK condition
+type serialItem struct {
+	b       byte
+	isBreak bool
+}
+
+// breakRequest : asks the serial writer of a port to transmit a BREAK between two writes
+type breakRequest struct {
+	duration time.Duration
+	result   chan error
+}
+
+// parmrkDecoder : decodes the input of a tty configured with PARMRK, where
+// \377 \377 is a literal \377, \377 \0 \0 is a BREAK and \377 \0 X is the byte X
+// received with a framing or parity error
+type parmrkDecoder struct {
+	state  int
+	errors int
+}
+
+func (decoder *parmrkDecoder) decode(data []byte, items []serialItem) []serialItem {
+	for _, b := range data {
+		switch decoder.state {
+		case 0:
+			if b == 0377 {
+				decoder.state = 1
+			} else {
+				items = append(items, serialItem{b: b})
+			}
+		case 1:
+			if b == 0 {
+				decoder.state = 2
+			} else {
+				if b != 0377 {
+					// Not a valid escape, pass both bytes through
+					items = append(items, serialItem{b: 0377})
+				}
+				items = append(items, serialItem{b: b})
+				decoder.state = 0
+			}
+		case 2:
+			if b == 0 {
+				items = append(items, serialItem{isBreak: true})
+			} else {
+				decoder.errors++
+				items = append(items, serialItem{b: b})
+			}
+			decoder.state = 0
+		}
+	}
+	return items
+}
+
+// requestBreak : have the writer of a running port transmit a BREAK
+func (handle *portHandle) requestBreak(duration time.Duration) error {
+	if duration <= 0 {
+		duration = defaultBreakDuration
+	}
+
+	request := breakRequest{duration, make(chan error, 1)}
+
+	select {
+	case handle.breakRequests <- request:
+	case <-time.After(5 * time.Second):
+		return errors.New("timed out waiting for the serial writer")
+	}
+
+	return <-request.result
+}
@@ -0,0 +1,107 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"syscall"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// openSerialPort : open and configure the serial port described by a port configuration
+func openSerialPort(ttyName string, portConfig PortConfig, logger Logger) (io.ReadWriteCloser, error) {
+	ttyPath, err := filepath.EvalSymlinks(ttyName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to share the tty, whoever else has it open would get half of our data
+	if pid := findTTYHolder(ttyPath); pid > 0 {
+		return nil, newPortBusyError(ttyName, pid)
+	}
+
+	lock, err := acquireUUCPLock(ttyPath, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	serialPort, err := openSerialPortUnlocked(ttyName, portConfig, logger)
+	if err != nil {
+		lock.release()
+		if errors.Is(err, syscall.EBUSY) {
+			// Someone else set TIOCEXCL, try to tell who
+			return nil, newPortBusyError(ttyName, findTTYHolder(ttyPath))
+		}
+		return nil, err
+	}
+
+	err = setExclusive(serialPort)
+	if err != nil {
+		logger("serial", LogWarning, "cannot get exclusive access to "+ttyName+": "+err.Error())
+	}
+
+	return &lockedSerialPort{ReadWriteCloser: serialPort, lock: lock}, nil
+}
+
+func openSerialPortUnlocked(ttyName string, portConfig PortConfig, logger Logger) (io.ReadWriteCloser, error) {
+	serialPortOptions := serial.OpenOptions{
+		PortName:              ttyName,
+		BaudRate:              uint(portConfig.BaudRate),
+		DataBits:              uint(portConfig.DataBits),
+		StopBits:              uint(portConfig.StopBits),
+		RTSCTSFlowControl:     portConfig.HardwareFlowControl,
+		MinimumReadSize:       0,
+		InterCharacterTimeout: 100,
+	}
+
+	serialPort, err := serial.Open(serialPortOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if portConfig.SoftwareFlowControl {
+		err = setSoftwareFlowControl(serialPort, true)
+		if err != nil {
+			serialPort.Close()
+			return nil, err
+		}
+	}
+
+	if portConfig.DetectBreak {
+		err = setParityMarking(serialPort)
+		if err != nil {
+			serialPort.Close()
+			return nil, err
+		}
+	}
+
+	if portConfig.RS485.Enabled {
+		err = setKernelRS485(serialPort, portConfig.RS485)
+		if err != nil {
+			logger("serial", LogInfo, ttyName+" has no kernel RS485 support ("+err.Error()+"), driving RTS in software")
+			return newSoftwareRS485Port(serialPort, portConfig.RS485)
+		}
+	}
+
+	return serialPort, nil
+}
@@ -0,0 +1,300 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Flags and layout of the kernel struct serial_rs485 (see linux/serial.h)
+const (
+	serRS485Enabled      = 1 << 0
+	serRS485RTSOnSend    = 1 << 1
+	serRS485RTSAfterSend = 1 << 2
+)
+
+type serialRS485 struct {
+	flags              uint32
+	delayRTSBeforeSend uint32
+	delayRTSAfterSend  uint32
+	padding            [5]uint32
+}
+
+// serialPortFd : get the file descriptor of an open serial port
+func serialPortFd(serialPort io.ReadWriteCloser) (int, error) {
+	file, ok := serialPort.(interface{ Fd() uintptr })
+	if !ok {
+		return -1, errors.New("serial port is not backed by a file descriptor")
+	}
+	return int(file.Fd()), nil
+}
+
+// setSoftwareFlowControl : enable or disable XON/XOFF flow control on an open serial port
+func setSoftwareFlowControl(serialPort io.ReadWriteCloser, enabled bool) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		termios.Iflag |= unix.IXON | unix.IXOFF
+	} else {
+		termios.Iflag &^= unix.IXON | unix.IXOFF
+	}
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+}
+
+// getBaudRate : read back the output baudrate actually configured by the tty driver
+func getBaudRate(serialPort io.ReadWriteCloser) (int, error) {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return 0, err
+	}
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(termios.Ospeed), nil
+}
+
+// setKernelRS485 : let the tty driver handle RS485 direction control with TIOCSRS485
+func setKernelRS485(serialPort io.ReadWriteCloser, rs485 RS485Config) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	settings := serialRS485{
+		flags:              serRS485Enabled,
+		delayRTSBeforeSend: uint32(rs485.DelayBeforeSend),
+		delayRTSAfterSend:  uint32(rs485.DelayAfterSend),
+	}
+	if rs485.InvertRTS {
+		settings.flags |= serRS485RTSAfterSend
+	} else {
+		settings.flags |= serRS485RTSOnSend
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TIOCSRS485), uintptr(unsafe.Pointer(&settings)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setRTS(fd int, level bool) error {
+	if level {
+		return unix.IoctlSetPointerInt(fd, unix.TIOCMBIS, unix.TIOCM_RTS)
+	}
+	return unix.IoctlSetPointerInt(fd, unix.TIOCMBIC, unix.TIOCM_RTS)
+}
+
+// softwareRS485Port : serial port that toggles RTS from userspace around every write,
+// for adapters whose driver does not implement TIOCSRS485
+type softwareRS485Port struct {
+	*os.File
+	rs485 RS485Config
+}
+
+func newSoftwareRS485Port(serialPort io.ReadWriteCloser, rs485 RS485Config) (io.ReadWriteCloser, error) {
+	file, ok := serialPort.(*os.File)
+	if !ok {
+		serialPort.Close()
+		return nil, errors.New("serial port is not backed by a file descriptor")
+	}
+
+	// Start in receive mode
+	err := setRTS(int(file.Fd()), rs485.InvertRTS)
+	if err != nil {
+		serialPort.Close()
+		return nil, err
+	}
+
+	return &softwareRS485Port{file, rs485}, nil
+}
+
+func (port *softwareRS485Port) Write(data []byte) (int, error) {
+	fd := int(port.Fd())
+
+	err := setRTS(fd, !port.rs485.InvertRTS)
+	if err != nil {
+		return 0, err
+	}
+	time.Sleep(time.Duration(port.rs485.DelayBeforeSend) * time.Millisecond)
+
+	n, err := port.File.Write(data)
+	if err == nil {
+		// tcdrain: wait for the last bit to leave the UART before turning around
+		err = unix.IoctlSetInt(fd, unix.TCSBRK, 1)
+	}
+
+	time.Sleep(time.Duration(port.rs485.DelayAfterSend) * time.Millisecond)
+	rtsErr := setRTS(fd, port.rs485.InvertRTS)
+	if err == nil {
+		err = rtsErr
+	}
+
+	return n, err
+}
+
+// getModemLines : read the modem control lines with TIOCMGET
+func getModemLines(serialPort io.ReadWriteCloser) (ModemLines, error) {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return ModemLines{}, err
+	}
+
+	bits, err := unix.IoctlGetInt(fd, unix.TIOCMGET)
+	if err != nil {
+		return ModemLines{}, err
+	}
+
+	return ModemLines{
+		CTS: bits&unix.TIOCM_CTS != 0,
+		DSR: bits&unix.TIOCM_DSR != 0,
+		DCD: bits&unix.TIOCM_CAR != 0,
+		RI:  bits&unix.TIOCM_RNG != 0,
+		DTR: bits&unix.TIOCM_DTR != 0,
+		RTS: bits&unix.TIOCM_RTS != 0,
+	}, nil
+}
+
+// setModemLines : drive the DTR and RTS output lines
+func setModemLines(serialPort io.ReadWriteCloser, update ModemLinesUpdate) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	if update.DTR != nil {
+		if *update.DTR {
+			err = unix.IoctlSetPointerInt(fd, unix.TIOCMBIS, unix.TIOCM_DTR)
+		} else {
+			err = unix.IoctlSetPointerInt(fd, unix.TIOCMBIC, unix.TIOCM_DTR)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if update.RTS != nil {
+		err = setRTS(fd, *update.RTS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setParityMarking : have the tty report BREAKs and framing/parity errors in band, see parmrkDecoder
+func setParityMarking(serialPort io.ReadWriteCloser) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+	if err != nil {
+		return err
+	}
+
+	termios.Iflag |= unix.PARMRK | unix.INPCK
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.IGNPAR | unix.ISTRIP
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+}
+
+// sendBreak : hold the TX line in the BREAK condition for the given duration
+func sendBreak(serialPort io.ReadWriteCloser, duration time.Duration) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	// Let pending data go out first, it would be cut by the BREAK otherwise
+	err = unix.IoctlSetInt(fd, unix.TCSBRK, 1)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlSetInt(fd, unix.TIOCSBRK, 0)
+	if err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	return unix.IoctlSetInt(fd, unix.TIOCCBRK, 0)
+}
+
+// releaseWrite : get a write held back by flow control (CTS low, XOFF, a pty nobody reads) out of
+// the kernel; the port is only good for closing afterwards. Output not transmitted yet is discarded,
+// the fd is made non-blocking, and setting the termios again wakes up the writer so that it sees it.
+// A read or write that then gets EAGAIN waits in the Go poller, the expired deadline ends that too
+func releaseWrite(serialPort io.ReadWriteCloser) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCOFLUSH); err != nil {
+		return err
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return err
+	}
+
+	if file, ok := serialPort.(interface{ SetDeadline(time.Time) error }); ok {
+		file.SetDeadline(time.Now())
+	}
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+}
+
+// setExclusive : make further opens of the tty fail with EBUSY, except for root
+func setExclusive(serialPort io.ReadWriteCloser) error {
+	fd, err := serialPortFd(serialPort)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetInt(fd, unix.TIOCEXCL, 0)
+}
+
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
@@ -0,0 +1,76 @@
+//go:build !linux
+
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var errNotSupported = errors.New("operation supported on Linux only")
+
+func setSoftwareFlowControl(serialPort io.ReadWriteCloser, enabled bool) error {
+	return errNotSupported
+}
+
+func getBaudRate(serialPort io.ReadWriteCloser) (int, error) {
+	return 0, errNotSupported
+}
+
+func setKernelRS485(serialPort io.ReadWriteCloser, rs485 RS485Config) error {
+	return errNotSupported
+}
+
+func newSoftwareRS485Port(serialPort io.ReadWriteCloser, rs485 RS485Config) (io.ReadWriteCloser, error) {
+	serialPort.Close()
+	return nil, errNotSupported
+}
+
+func getModemLines(serialPort io.ReadWriteCloser) (ModemLines, error) {
+	return ModemLines{}, errNotSupported
+}
+
+func setModemLines(serialPort io.ReadWriteCloser, update ModemLinesUpdate) error {
+	return errNotSupported
+}
+
+func setParityMarking(serialPort io.ReadWriteCloser) error {
+	return errNotSupported
+}
+
+func sendBreak(serialPort io.ReadWriteCloser, duration time.Duration) error {
+	return errNotSupported
+}
+
+func releaseWrite(serialPort io.ReadWriteCloser) error {
+	return errNotSupported
+}
+
+func setExclusive(serialPort io.ReadWriteCloser) error {
+	return errNotSupported
+}
+
+func processAlive(pid int) bool {
+	// Assume the worst, a stale lock file is easier to deal with than a corrupted stream
+	return true
+}
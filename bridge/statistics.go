@@ -0,0 +1,215 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// portStatistics : represent the statistics for one port; the counters only ever
+// increase and are updated atomically by the port threads, rates are derived from
+// the snapshots taken by the statistics thread
+type portStatistics struct {
+	State    portState
+	BaudRate atomic.Int64
+
+	UDP2SerialBytes atomic.Int64
+	Serial2UDPBytes atomic.Int64
+	LostPackets     atomic.Int64
+	Errors          atomic.Int64
+
+	// nanoseconds spent waiting on flow control
+	FlowControlBlocked atomic.Int64
+
+	Lines atomic.Pointer[ModemLines]
+
+	Breaks        atomic.Int64
+	FramingErrors atomic.Int64
+
+	// the last two snapshots taken by the statistics thread
+	snapshotsMutex sync.Mutex
+	previous       counterSnapshot
+	latest         counterSnapshot
+}
+
+// counterSnapshot : the counters of a port at a point in time
+type counterSnapshot struct {
+	time time.Time
+
+	udp2serialBytes    int64
+	serial2udpBytes    int64
+	lostPackets        int64
+	errors             int64
+	flowControlBlocked int64
+	breaks             int64
+	framingErrors      int64
+}
+
+func (stats *portStatistics) snapshot(now time.Time) counterSnapshot {
+	return counterSnapshot{
+		time:               now,
+		udp2serialBytes:    stats.UDP2SerialBytes.Load(),
+		serial2udpBytes:    stats.Serial2UDPBytes.Load(),
+		lostPackets:        stats.LostPackets.Load(),
+		errors:             stats.Errors.Load(),
+		flowControlBlocked: stats.FlowControlBlocked.Load(),
+		breaks:             stats.Breaks.Load(),
+		framingErrors:      stats.FramingErrors.Load(),
+	}
+}
+
+// record : keep a snapshot taken by the statistics thread, rates are computed over
+// the interval between the last two
+func (stats *portStatistics) record(snapshot counterSnapshot) {
+	stats.snapshotsMutex.Lock()
+	stats.previous = stats.latest
+	stats.latest = snapshot
+	stats.snapshotsMutex.Unlock()
+}
+
+// rates : bytes per second in each direction, and the fraction of time blocked by
+// flow control in milliseconds per second, over the last snapshot interval
+func (stats *portStatistics) rates() (int, int, int) {
+	stats.snapshotsMutex.Lock()
+	defer stats.snapshotsMutex.Unlock()
+
+	if stats.previous.time.IsZero() {
+		return 0, 0, 0
+	}
+	elapsed := stats.latest.time.Sub(stats.previous.time).Seconds()
+	if elapsed <= 0 {
+		return 0, 0, 0
+	}
+
+	perSecond := func(before int64, after int64) int {
+		return int(float64(after-before) / elapsed)
+	}
+	return perSecond(stats.previous.udp2serialBytes, stats.latest.udp2serialBytes),
+		perSecond(stats.previous.serial2udpBytes, stats.latest.serial2udpBytes),
+		perSecond(stats.previous.flowControlBlocked, stats.latest.flowControlBlocked) / int(time.Millisecond)
+}
+
+// PublicPortStatistics : represent the public information about a port statistics
+type PublicPortStatistics struct {
+	State      string    `json:"state"`
+	StateSince time.Time `json:"stateSince"`
+	LastError  string    `json:"lastError,omitempty"`
+	Restarts   int       `json:"restarts"`
+	BaudRate   int       `json:"baudrate"`
+
+	UDP2SerialRate int `json:"udp2serialRate"`
+	Serial2UDPRate int `json:"serial2udpRate"`
+	LostPackets    int `json:"lostPackets"`
+	Errors         int `json:"errors"`
+
+	// bytes forwarded since the port was first started
+	UDP2SerialBytes int64 `json:"udp2serialBytes"`
+	Serial2UDPBytes int64 `json:"serial2udpBytes"`
+
+	// milliseconds spent waiting on flow control during the last second
+	FlowControlBlocked int `json:"flowControlBlocked"`
+
+	Lines *ModemLines `json:"lines,omitempty"`
+
+	Breaks        int `json:"breaks"`
+	FramingErrors int `json:"framingErrors"`
+}
+
+// statistics : represent statistics for all ports
+type statistics struct {
+	ports      map[string]*portStatistics
+	portsMutex sync.Mutex
+}
+
+// PublicStatistics : represent the public statistics information
+type PublicStatistics struct {
+	// when the counters were read, the same instant for every port
+	Time  time.Time                       `json:"time"`
+	Ports map[string]PublicPortStatistics `json:"ports"`
+}
+
+func (stats *portStatistics) public(portName string, now time.Time) PublicPortStatistics {
+	status := stats.State.status(portName)
+	counters := stats.snapshot(now)
+	udp2serialRate, serial2udpRate, flowControlBlocked := stats.rates()
+
+	return PublicPortStatistics{
+		status.State,
+		status.Since,
+		status.LastError,
+		status.Restarts,
+		int(stats.BaudRate.Load()),
+		udp2serialRate,
+		serial2udpRate,
+		int(counters.lostPackets),
+		int(counters.errors),
+		counters.udp2serialBytes,
+		counters.serial2udpBytes,
+		flowControlBlocked,
+		stats.Lines.Load(),
+		int(counters.breaks),
+		int(counters.framingErrors),
+	}
+}
+
+func (stats *statistics) public() PublicStatistics {
+	result := PublicStatistics{}
+	result.Ports = make(map[string]PublicPortStatistics)
+
+	stats.portsMutex.Lock()
+
+	result.Time = time.Now()
+	for portName := range stats.ports {
+		result.Ports[portName] = stats.ports[portName].public(portName, result.Time)
+	}
+
+	stats.portsMutex.Unlock()
+
+	return result
+}
+
+func (m *Manager) statisticsThread(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	stats := &m.statistics
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		stats.portsMutex.Lock()
+
+		now := time.Now()
+		for portName := range stats.ports {
+			stats.ports[portName].record(stats.ports[portName].snapshot(now))
+		}
+
+		stats.portsMutex.Unlock()
+	}
+}
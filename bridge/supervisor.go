@@ -0,0 +1,493 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a stopping thread may take to write out its queued packets,
+// and how long shutdown waits for all the threads, or stopThread for one
+const (
+	drainTimeout = 2 * time.Second
+	// unless Options.ShutdownTimeout says otherwise
+	shutdownTimeout = 5 * time.Second
+	// where the UDP input cannot be read without waiting, how long it is drained for
+	udpDrainIdle = 50 * time.Millisecond
+)
+
+// portThread : supervisor bookkeeping for the thread bridging a port
+type portThread struct {
+	name   string
+	cancel context.CancelFunc
+	// closed by the supervisor once the thread has stopped
+	done chan struct{}
+	// set when the thread must not be respawned after it stops
+	stopped bool
+	// set when the thread is killed to be respawned right away
+	restartRequested bool
+	// consecutive failures, for the restart backoff
+	failures int
+	started  time.Time
+	// accessed atomically, non-zero while traffic is not forwarded
+	paused int32
+}
+
+func (thread *portThread) isPaused() bool {
+	return atomic.LoadInt32(&thread.paused) != 0
+}
+
+// portHandle : gives access to the serial port of a running thread
+type portHandle struct {
+	serialPort       io.ReadWriteCloser
+	portConfig       PortConfig
+	breakRequests    chan breakRequest
+	autobaudRequests chan autobaudRequest
+}
+
+func (m *Manager) rebuildStatistics() {
+	m.statistics.portsMutex.Lock()
+
+	m.statistics.ports = make(map[string]*portStatistics)
+
+	for _, portConfig := range m.Config().Ports {
+		m.statistics.ports[portConfig.Name] = m.newPortStatistics()
+	}
+
+	m.statistics.portsMutex.Unlock()
+}
+
+func (m *Manager) newPortStatistics() *portStatistics {
+	stats := &portStatistics{}
+	stats.State.logger = m.logger
+	return stats
+}
+
+// getPortStatistics : statistics of a port, created if the port has none yet
+func (m *Manager) getPortStatistics(portName string) *portStatistics {
+	m.statistics.portsMutex.Lock()
+	defer m.statistics.portsMutex.Unlock()
+
+	stats, ok := m.statistics.ports[portName]
+	if !ok {
+		stats = m.newPortStatistics()
+		m.statistics.ports[portName] = stats
+	}
+	return stats
+}
+
+// spawnThread : launch the thread of a port, threadsMutex must be held
+func (m *Manager) spawnThread(portConfig PortConfig, paused bool) *portThread {
+	ctx, cancel := context.WithCancel(m.ctx)
+	thread := &portThread{
+		name:    portConfig.Name,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		started: time.Now(),
+	}
+	if paused {
+		thread.paused = 1
+	}
+	m.threads[portConfig.Name] = thread
+	m.liveThreads++
+
+	stats := m.getPortStatistics(portConfig.Name)
+	stats.State.set("supervisor", PortStateStarting)
+
+	name := "UDPSerialThread_" + portConfig.Name
+	go m.udpSerialThread(ctx, name, portConfig, thread, stats)
+
+	return thread
+}
+
+// respawnThread : replace a thread that has ended, threadsMutex must be held
+func (m *Manager) respawnThread(portName string, thread *portThread) *portThread {
+	portConfig, err := m.Config().Port(portName)
+	if err != nil {
+		m.logger("supervisor", LogError, err)
+		delete(m.threads, portName)
+		return nil
+	}
+
+	m.getPortStatistics(portName).State.restarted()
+	return m.spawnThread(portConfig, thread.isPaused())
+}
+
+// threadEnded : whether the supervisor has already seen the thread stop
+func threadEnded(thread *portThread) bool {
+	select {
+	case <-thread.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// threadDied : bookkeeping for a thread that reported on stopChannel, threadsMutex must be held;
+// tells whether it is still the thread of its port
+func (m *Manager) threadDied(died *portThread) bool {
+	close(died.done)
+	m.liveThreads--
+	return m.threads[died.name] == died
+}
+
+// forgetThread : drop a thread that was stopped while waiting for its restart backoff
+func (m *Manager) forgetThread(portName string, thread *portThread) {
+	m.threadsMutex.Lock()
+	if m.threads[portName] == thread {
+		delete(m.threads, portName)
+	}
+	m.threadsMutex.Unlock()
+
+	m.getPortStatistics(portName).State.swap("supervisor", PortStateFailed, PortStateStopped)
+}
+
+func (m *Manager) startAndSuperviseThreads(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	m.logger("supervisor", LogInfo, "Starting threads")
+
+	m.rebuildStatistics()
+
+	m.threadsMutex.Lock()
+	m.ctx = ctx
+	for _, portConfig := range m.Config().Ports {
+		m.spawnThread(portConfig, false)
+	}
+	m.threadsMutex.Unlock()
+
+	heartbeat := time.NewTicker(supervisorHeartbeatInterval)
+	defer heartbeat.Stop()
+	atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+
+	// Start supervising
+	for {
+		var died *portThread
+		select {
+		case died = <-m.stopChannel:
+		case <-heartbeat.C:
+			// Also proves that the threads are not deadlocked
+			m.threadsMutex.Lock()
+			m.threadsMutex.Unlock()
+			atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+			continue
+		case <-ctx.Done():
+			m.shutdownThreads()
+			return
+		}
+
+		m.threadsMutex.Lock()
+		diedPortName, thread := died.name, died
+		if !m.threadDied(died) {
+			// Replaced after stopThread gave up waiting for it
+			m.threadsMutex.Unlock()
+			continue
+		}
+
+		if thread.stopped || ctx.Err() != nil {
+			delete(m.threads, diedPortName)
+			m.threadsMutex.Unlock()
+			continue
+		}
+
+		if thread.restartRequested {
+			m.respawnThread(diedPortName, thread)
+			m.threadsMutex.Unlock()
+			continue
+		}
+
+		// The thread failed, relaunch it after a backoff that grows while it keeps failing
+		failures := thread.failures + 1
+		if time.Since(thread.started) > restartBackoffReset {
+			failures = 1
+		}
+		delay := restartBackoff(failures)
+		thread.failures = failures
+		m.threadsMutex.Unlock()
+
+		m.logger("supervisor", LogWarning, "Port "+diedPortName+" failed, restarting in "+delay.String())
+
+		m.getPortStatistics(diedPortName).State.scheduleRestart(time.Now().Add(delay))
+
+		portName := diedPortName
+		time.AfterFunc(delay, func() {
+			m.threadsMutex.Lock()
+			defer m.threadsMutex.Unlock()
+
+			// Stopped, restarted or replaced in the meantime
+			if m.threads[portName] != thread || thread.stopped || ctx.Err() != nil {
+				return
+			}
+			if respawned := m.respawnThread(portName, thread); respawned != nil {
+				respawned.failures = failures
+			}
+		})
+	}
+}
+
+// shutdownThreads : stop every thread, giving them the shutdown timeout to write out
+// their queues and close, called by the supervisor loop once its context is cancelled
+func (m *Manager) shutdownThreads() {
+	m.threadsMutex.Lock()
+	for portName, thread := range m.threads {
+		thread.stopped = true
+		thread.cancel()
+		if threadEnded(thread) {
+			// Waiting for its restart backoff, nothing to stop
+			delete(m.threads, portName)
+			m.getPortStatistics(portName).State.swap("supervisor", PortStateFailed, PortStateStopped)
+		}
+	}
+	remaining := m.liveThreads
+	m.threadsMutex.Unlock()
+
+	m.logger("supervisor", LogInfo, "Waiting for "+strconv.Itoa(remaining)+" threads to stop")
+
+	deadline := time.After(m.shutdownTimeout)
+	for remaining > 0 {
+		select {
+		case died := <-m.stopChannel:
+			remaining = m.collectThread(died)
+		case <-deadline:
+			m.logger("supervisor", LogWarning, strconv.Itoa(remaining)+" threads did not stop in time")
+			// They still report once they end, and cannot end until someone listens
+			go func() {
+				for remaining > 0 {
+					remaining = m.collectThread(<-m.stopChannel)
+				}
+			}()
+			return
+		}
+	}
+
+	m.logger("supervisor", LogInfo, "All threads stopped")
+}
+
+// collectThread : forget a thread that ended during shutdown, returns how many are still running
+func (m *Manager) collectThread(died *portThread) int {
+	m.threadsMutex.Lock()
+	defer m.threadsMutex.Unlock()
+
+	if m.threadDied(died) {
+		delete(m.threads, died.name)
+	}
+	return m.liveThreads
+}
+
+// Apply : replace the running configuration, touching only the ports that
+// were added, removed or changed
+func (m *Manager) Apply(newConfig Config) ConfigDiff {
+	m.applyMutex.Lock()
+	defer m.applyMutex.Unlock()
+	return m.apply(newConfig)
+}
+
+// apply : Apply, with applyMutex held
+func (m *Manager) apply(newConfig Config) ConfigDiff {
+	diff := DiffConfig(m.Config(), newConfig)
+
+	m.logger("supervisor", LogInfo, "Applying configuration: "+strconv.Itoa(len(diff.Added))+" added, "+
+		strconv.Itoa(len(diff.Removed))+" removed, "+strconv.Itoa(len(diff.Changed))+" changed")
+
+	// Stop first, so that the sockets of the old ports are free for the new ones
+	restart := make(map[string]bool)
+	paused := make(map[string]bool)
+	for _, portName := range append(append([]string{}, diff.Removed...), diff.Changed...) {
+		m.threadsMutex.Lock()
+		thread, running := m.threads[portName]
+		m.threadsMutex.Unlock()
+
+		if running {
+			restart[portName] = true
+			paused[portName] = thread.isPaused()
+			m.stopThread(portName)
+		}
+	}
+
+	for _, portName := range diff.Removed {
+		m.statistics.portsMutex.Lock()
+		delete(m.statistics.ports, portName)
+		m.statistics.portsMutex.Unlock()
+	}
+
+	m.setConfig(newConfig)
+
+	// Ports stopped by an operator stay stopped, paused ones stay paused
+	m.threadsMutex.Lock()
+	if m.ctx == nil || m.ctx.Err() != nil {
+		// Run starts the ports of the configuration it finds
+		m.threadsMutex.Unlock()
+		return diff
+	}
+	for _, portConfig := range newConfig.Ports {
+		if restart[portConfig.Name] {
+			m.spawnThread(portConfig, paused[portConfig.Name])
+		}
+	}
+	for _, portName := range diff.Added {
+		portConfig, _ := newConfig.Port(portName)
+		m.spawnThread(portConfig, false)
+	}
+	m.threadsMutex.Unlock()
+
+	return diff
+}
+
+// startThread : start the thread of a configured port that is not running
+func (m *Manager) startThread(portName string) error {
+	m.threadsMutex.Lock()
+	defer m.threadsMutex.Unlock()
+
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return errNotRunning
+	}
+
+	if thread, ok := m.threads[portName]; ok {
+		if thread.stopped {
+			return errors.New("port " + portName + " is stopping")
+		}
+		if threadEnded(thread) {
+			// Failed and waiting for its restart, do not wait any longer
+			m.logger("supervisor", LogInfo, "Starting thread for port "+portName)
+			m.respawnThread(portName, thread)
+			return nil
+		}
+		return errors.New("port " + portName + " is already running")
+	}
+
+	portConfig, err := m.Config().Port(portName)
+	if err != nil {
+		return err
+	}
+
+	m.logger("supervisor", LogInfo, "Starting thread for port "+portName)
+
+	m.spawnThread(portConfig, false)
+	return nil
+}
+
+// stopThread : stop the thread of a single port and wait for it, it is not respawned
+func (m *Manager) stopThread(portName string) error {
+	m.threadsMutex.Lock()
+	thread, ok := m.threads[portName]
+	if !ok || thread.stopped {
+		m.threadsMutex.Unlock()
+		return errors.New("port " + portName + " is not running")
+	}
+	thread.stopped = true
+	m.threadsMutex.Unlock()
+
+	m.logger("supervisor", LogInfo, "Stopping thread for port "+portName)
+
+	thread.cancel()
+	select {
+	case <-thread.done:
+	case <-time.After(m.shutdownTimeout):
+		// Left to the supervisor, which forgets it once it ends
+		m.logger("supervisor", LogError, "Port "+portName+" did not stop in time")
+		return errors.New("port " + portName + " did not stop in time")
+	}
+	m.forgetThread(portName, thread)
+	return nil
+}
+
+// restartThread : kill the thread of a single port, the supervisor then respawns it
+// with the current configuration and definitions
+func (m *Manager) restartThread(portName string) error {
+	m.threadsMutex.Lock()
+	if m.ctx == nil || m.ctx.Err() != nil {
+		m.threadsMutex.Unlock()
+		return errNotRunning
+	}
+	thread, ok := m.threads[portName]
+	if !ok || thread.stopped {
+		m.threadsMutex.Unlock()
+		return errors.New("port " + portName + " is not running")
+	}
+
+	m.logger("supervisor", LogInfo, "Restarting thread for port "+portName)
+
+	if threadEnded(thread) {
+		// Failed and waiting for its restart
+		m.respawnThread(portName, thread)
+		m.threadsMutex.Unlock()
+		return nil
+	}
+	thread.restartRequested = true
+	m.threadsMutex.Unlock()
+
+	thread.cancel()
+	return nil
+}
+
+// pauseThread : stop or resume forwarding traffic on a port, keeping its
+// serial port and sockets open
+func (m *Manager) pauseThread(portName string, paused bool) error {
+	m.threadsMutex.Lock()
+	thread, ok := m.threads[portName]
+	m.threadsMutex.Unlock()
+
+	if !ok || thread.stopped {
+		return errors.New("port " + portName + " is not running")
+	}
+
+	stats := m.getPortStatistics(portName)
+	if paused {
+		m.logger("supervisor", LogInfo, "Pausing port "+portName)
+		atomic.StoreInt32(&thread.paused, 1)
+		stats.State.swap("supervisor", PortStateRunning, PortStatePaused)
+	} else {
+		m.logger("supervisor", LogInfo, "Resuming port "+portName)
+		atomic.StoreInt32(&thread.paused, 0)
+		stats.State.swap("supervisor", PortStatePaused, PortStateRunning)
+	}
+	return nil
+}
+
+func (m *Manager) registerPortHandle(handle *portHandle) {
+	m.handlesMutex.Lock()
+	m.handles[handle.portConfig.Name] = handle
+	m.handlesMutex.Unlock()
+}
+
+func (m *Manager) unregisterPortHandle(handle *portHandle) {
+	m.handlesMutex.Lock()
+	if m.handles[handle.portConfig.Name] == handle {
+		delete(m.handles, handle.portConfig.Name)
+	}
+	m.handlesMutex.Unlock()
+}
+
+func (m *Manager) getPortHandle(portName string) (*portHandle, error) {
+	m.handlesMutex.Lock()
+	defer m.handlesMutex.Unlock()
+
+	handle, ok := m.handles[portName]
+	if !ok {
+		return nil, &PortNotRunningError{portName}
+	}
+	return handle, nil
+}
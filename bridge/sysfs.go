@@ -0,0 +1,256 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const devSerialByID = "/dev/serial/by-id"
+const devSerialByPath = "/dev/serial/by-path"
+
+// SerialDevice : a serial device present on the system, as described by sysfs
+type SerialDevice struct {
+	Name         string   `json:"name"`
+	TTY          string   `json:"tty"`
+	Driver       string   `json:"driver,omitempty"`
+	VendorID     string   `json:"vendorId,omitempty"`
+	ProductID    string   `json:"productId,omitempty"`
+	Serial       string   `json:"serial,omitempty"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Product      string   `json:"product,omitempty"`
+	Interface    *int     `json:"interface,omitempty"`
+	ByID         []string `json:"byId,omitempty"`
+	ByPath       []string `json:"byPath,omitempty"`
+}
+
+func readSysfsAttribute(dir string, attribute string) string {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, attribute))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes))
+}
+
+// readDeviceLinks : map every tty to the symlinks pointing at it in a /dev/serial directory
+func readDeviceLinks(dir string) map[string][]string {
+	result := make(map[string][]string)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return result
+	}
+
+	for _, entry := range entries {
+		link := filepath.Join(dir, entry.Name())
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			continue
+		}
+		result[target] = append(result[target], link)
+	}
+
+	return result
+}
+
+// ListSerialDevices : enumerate the serial devices backed by real hardware
+func ListSerialDevices() []SerialDevice {
+	var devices []SerialDevice
+
+	entries, err := ioutil.ReadDir(sysfsTTYClass)
+	if err != nil {
+		return devices
+	}
+
+	byID := readDeviceLinks(devSerialByID)
+	byPath := readDeviceLinks(devSerialByPath)
+
+	for _, entry := range entries {
+		ttyDir := filepath.Join(sysfsTTYClass, entry.Name())
+
+		// Virtual terminals, ptys and the like have no device behind them
+		deviceDir, err := filepath.EvalSymlinks(filepath.Join(ttyDir, "device"))
+		if err != nil {
+			continue
+		}
+
+		device := SerialDevice{
+			Name: entry.Name(),
+			TTY:  "/dev/" + entry.Name(),
+		}
+
+		// UART slots that are not backed by a chip
+		if readSysfsAttribute(ttyDir, "type") == "0" {
+			continue
+		}
+
+		// Recent kernels put serial core port/controller devices in between, skip them
+		for dir := deviceDir; strings.HasPrefix(dir, "/sys/devices"); dir = filepath.Dir(dir) {
+			driver, err := os.Readlink(filepath.Join(dir, "driver"))
+			if err == nil && !strings.Contains(driver, "/bus/serial-base/") {
+				device.Driver = filepath.Base(driver)
+				break
+			}
+		}
+
+		// Walk up to the USB interface and the USB device, if any
+		for dir := deviceDir; strings.HasPrefix(dir, "/sys/devices"); dir = filepath.Dir(dir) {
+			if device.Interface == nil {
+				if value := readSysfsAttribute(dir, "bInterfaceNumber"); value != "" {
+					if number, err := strconv.ParseInt(value, 16, 32); err == nil {
+						interfaceNumber := int(number)
+						device.Interface = &interfaceNumber
+					}
+				}
+			}
+			if vendorID := readSysfsAttribute(dir, "idVendor"); vendorID != "" {
+				device.VendorID = vendorID
+				device.ProductID = readSysfsAttribute(dir, "idProduct")
+				device.Serial = readSysfsAttribute(dir, "serial")
+				device.Manufacturer = readSysfsAttribute(dir, "manufacturer")
+				device.Product = readSysfsAttribute(dir, "product")
+				break
+			}
+		}
+
+		device.ByID = byID[device.TTY]
+		device.ByPath = byPath[device.TTY]
+
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+
+	return devices
+}
+
+// matches : tell whether a device satisfies every criterion set in the match
+func (match DeviceMatch) matches(device SerialDevice) bool {
+	if match.VendorID != "" && !strings.EqualFold(match.VendorID, device.VendorID) {
+		return false
+	}
+	if match.ProductID != "" && !strings.EqualFold(match.ProductID, device.ProductID) {
+		return false
+	}
+	if match.Serial != "" && match.Serial != device.Serial {
+		return false
+	}
+	if match.Interface != nil && (device.Interface == nil || *match.Interface != *device.Interface) {
+		return false
+	}
+	if match.ByPath != "" {
+		byPath := match.ByPath
+		if !filepath.IsAbs(byPath) {
+			byPath = filepath.Join(devSerialByPath, byPath)
+		}
+		found := false
+		for _, path := range device.ByPath {
+			if path == byPath {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// claimedDevices : map every tty that a definition currently resolves to, to the definition port name
+func claimedDevices(definitions Definitions, logger Logger) map[string]string {
+	result := make(map[string]string)
+
+	for _, portDefinition := range definitions.PortDefinitions {
+		ttyName, err := resolvePortDefinition(portDefinition, logger)
+		if err != nil {
+			continue
+		}
+		// Definitions may point at /dev/serial/by-id links and the like
+		if target, err := filepath.EvalSymlinks(ttyName); err == nil {
+			ttyName = target
+		}
+		result[ttyName] = portDefinition.PortName
+	}
+
+	return result
+}
+
+// FindSerialDevice : look up a present device by its tty name, e.g. ttyUSB0
+func FindSerialDevice(name string) (SerialDevice, error) {
+	for _, device := range ListSerialDevices() {
+		if device.Name == name {
+			return device, nil
+		}
+	}
+	return SerialDevice{}, errors.New("no such serial device " + name)
+}
+
+// DefinitionForDevice : build a definition for a device, identified in the most stable way available
+// unless matchBy asks for one of "tty", "byId", "byPath" or "usb"
+func DefinitionForDevice(device SerialDevice, portName string, matchBy string) (PortDefinition, error) {
+	if matchBy == "" {
+		switch {
+		case device.VendorID != "" && device.Serial != "":
+			matchBy = "usb"
+		case len(device.ByPath) > 0:
+			matchBy = "byPath"
+		default:
+			matchBy = "tty"
+		}
+	}
+
+	portDefinition := PortDefinition{PortName: portName}
+
+	switch matchBy {
+	case "tty":
+		portDefinition.TTY = device.TTY
+	case "byId":
+		if len(device.ByID) == 0 {
+			return PortDefinition{}, errors.New(device.Name + " has no /dev/serial/by-id link")
+		}
+		portDefinition.TTY = device.ByID[0]
+	case "byPath":
+		if len(device.ByPath) == 0 {
+			return PortDefinition{}, errors.New(device.Name + " has no /dev/serial/by-path link")
+		}
+		portDefinition.Match = &DeviceMatch{ByPath: filepath.Base(device.ByPath[0])}
+	case "usb":
+		if device.VendorID == "" {
+			return PortDefinition{}, errors.New(device.Name + " is not a USB device")
+		}
+		portDefinition.Match = &DeviceMatch{
+			VendorID:  device.VendorID,
+			ProductID: device.ProductID,
+			Serial:    device.Serial,
+			Interface: device.Interface,
+		}
+	default:
+		return PortDefinition{}, errors.New("unknown match type " + matchBy)
+	}
+
+	return portDefinition, nil
+}
@@ -0,0 +1,699 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrintDebug : print debug information while running
+const PrintDebug = false
+
+func findPacketSeparator(buffer []byte, separator string) int {
+	for i, b := range buffer {
+		if b == separator[0] {
+			return i
+		}
+	}
+	return -1
+}
+
+func parsePacketSeparator(ps string) string {
+	result := ps
+	result = strings.Replace(result, "\\n", "\n", -1)
+	result = strings.Replace(result, "\\r", "\r", -1)
+	result = strings.Replace(result, "\\0", "\000", -1)
+	result = strings.Replace(result, "\\t", "\t", -1)
+	return result
+}
+
+// releaseHeldWrite : get the writer of a stopping port out of a write that flow control holds back,
+// closing the port does not help since the close waits for the write
+func (m *Manager) releaseHeldWrite(name string, port io.ReadWriteCloser, writerDone <-chan struct{}) {
+	deadline := time.After(drainTimeout)
+	for {
+		if err := releaseWrite(port); err != nil {
+			m.logger(name, LogWarning, "cannot release the serial write: "+err.Error())
+			return
+		}
+		select {
+		case <-writerDone:
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			m.logger(name, LogError, "serial write still blocked")
+			return
+		}
+	}
+}
+
+// udpSerialThread : start a loop for a specified port
+func (m *Manager) udpSerialThread(ctx context.Context, name string, portConfig PortConfig, thread *portThread, stats *portStatistics) {
+	defer func() { m.stopChannel <- thread }()
+
+	m.logger(name, LogInfo, "Starting thread")
+	stats.State.set(name, PortStateStarting)
+
+	defer func() {
+		if ctx.Err() == nil {
+			// Ended by itself, the supervisor restarts it
+			stats.State.set(name, PortStateFailed)
+		} else {
+			stats.State.set(name, PortStateStopped)
+		}
+	}()
+
+	// Get serial port TTY, a definition matching a device that is not plugged in is fine
+	ttyName, err := getPortTTY(m.Definitions(), portConfig.Name, m.logger)
+	if err != nil && err != errDeviceNotFound {
+		m.logger(name, LogError, err)
+		stats.Errors.Add(1)
+		stats.State.setError(err)
+		return
+	}
+
+	// UDP Input Address
+	udpInputAddress, err := net.ResolveUDPAddr("udp", portConfig.UDPInputIP+":"+strconv.Itoa(portConfig.UDPInputPort))
+	if err != nil {
+		m.logger(name, LogError, err)
+		stats.Errors.Add(1)
+		stats.State.setError(err)
+		return
+	}
+
+	// UDP Output Address
+	udpOutputAddress := portConfig.UDPOutputIP + ":" + strconv.Itoa(portConfig.UDPOutputPort)
+
+	// Open UDP input connection
+	udpInputConnection, err := net.ListenUDP("udp", udpInputAddress)
+	if err != nil {
+		m.logger(name, LogError, err)
+		stats.Errors.Add(1)
+		stats.State.setError(err)
+		return
+	}
+	m.logger(name, LogInfo, "Listening on "+udpInputAddress.String())
+	defer udpInputConnection.Close()
+
+	// Open UDP output connection
+	udpOutputConnection, err := net.Dial("udp", udpOutputAddress)
+	if err != nil {
+		m.logger(name, LogError, err)
+		stats.Errors.Add(1)
+		stats.State.setError(err)
+		return
+	}
+	m.logger(name, LogInfo, "Sending to "+udpOutputAddress)
+	defer udpOutputConnection.Close()
+
+	// Open control events connection
+	control, err := openControlSender(portConfig)
+	if err != nil {
+		m.logger(name, LogError, err)
+		stats.Errors.Add(1)
+		stats.State.setError(err)
+		return
+	}
+	defer control.close()
+
+	var udpBuffer = make([]byte, 5100)
+
+	var serial2udpChannel = make(chan []byte, 64)
+
+	var udp2serialChannel = make(chan []byte, 64)
+
+	var breakMessage []byte
+	if portConfig.BreakMessage != "" {
+		breakMessage = []byte(parsePacketSeparator(portConfig.BreakMessage))
+	}
+	breakDuration := time.Duration(portConfig.BreakDuration) * time.Millisecond
+
+	// The serial port comes and goes with the device, the UDP side stays up
+	var serialPort io.ReadWriteCloser
+	var serialPortMutex sync.Mutex
+
+	deviceOpen := func() bool {
+		serialPortMutex.Lock()
+		defer serialPortMutex.Unlock()
+		return serialPort != nil
+	}
+
+	var internalWaitGroup sync.WaitGroup
+
+	// Closed when the UDP input has been read for the last time
+	var udpInputDone = make(chan struct{})
+
+	internalWaitGroup.Add(1)
+	go func() {
+		defer internalWaitGroup.Done()
+		defer close(udpInputDone)
+		//var readAddr *net.UDPAddr
+		forward := func(readLength int) {
+			if !deviceOpen() {
+				// Nowhere to write to until the device comes back
+				stats.LostPackets.Add(1)
+			} else if thread.isPaused() {
+				// Dropped on purpose while the port is paused
+				stats.LostPackets.Add(1)
+			} else {
+				stats.UDP2SerialBytes.Add(int64(readLength))
+				if PrintDebug {
+					fmt.Println("UDP in ", udpBuffer[0:readLength])
+				}
+				packet := make([]byte, readLength)
+				copy(packet, udpBuffer[:readLength])
+				if breakMessage != nil && bytes.Equal(packet, breakMessage) {
+					// In-band request for a BREAK, handled by the writer in order with the data
+					packet = nil
+				}
+				// Wait while the serial writer is held back by flow control
+				for queued := false; !queued; {
+					select {
+					case udp2serialChannel <- packet:
+						queued = true
+					case <-time.After(100 * time.Millisecond):
+						if !deviceOpen() {
+							stats.LostPackets.Add(1)
+							queued = true
+						}
+					}
+				}
+			}
+		}
+		for {
+			readLength, _, err := udpInputConnection.ReadFromUDP(udpBuffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+				// Woken up by the kill
+				break
+			} else if err != nil {
+				m.logger(name, LogWarning, err)
+			} else {
+				forward(readLength)
+			}
+		}
+		// Take what was received before the kill, but not what keeps arriving
+		err := readQueuedUDP(udpInputConnection, udpBuffer, forward)
+		if err != nil {
+			m.logger(name, LogWarning, "cannot read the queued UDP packets: "+err.Error())
+		}
+		m.logger(name, LogInfo, "udp2serial subthread stopped")
+	}()
+
+	// Closed once no session can produce packets anymore, the sender then flushes the queue and ends
+	var sessionsOver = make(chan struct{})
+
+	var senderWaitGroup sync.WaitGroup
+	senderWaitGroup.Add(1)
+	go func() {
+		defer senderWaitGroup.Done()
+		send := func(toSend []byte) {
+			if PrintDebug {
+				fmt.Println("UDP out ", toSend)
+			}
+			_, err := udpOutputConnection.Write(toSend)
+			if err != nil {
+				// TODO do not repeat error for every packet
+				// m.logger(name, LogWarning, err)
+				if PrintDebug {
+					fmt.Printf("UDP refused for packet %q\n", toSend)
+				}
+				stats.LostPackets.Add(1)
+			} else {
+				if PrintDebug {
+					fmt.Printf("UDP sent for packet %q\n", toSend)
+				}
+			}
+		}
+		for {
+			select {
+			case toSend := <-serial2udpChannel:
+				send(toSend)
+			case <-sessionsOver:
+				for len(serial2udpChannel) > 0 {
+					send(<-serial2udpChannel)
+				}
+				m.logger(name, LogInfo, "udpqueue2udp subthread stopped")
+				return
+			}
+		}
+	}()
+
+	internalWaitGroup.Add(1)
+	go func() {
+		defer internalWaitGroup.Done()
+		<-ctx.Done()
+		m.logger(name, LogInfo, "Thread received kill signal")
+		// Wakes up the UDP reader, which then only takes what is already buffered
+		udpInputConnection.SetReadDeadline(time.Now())
+	}()
+
+	// Port configuration of the current session, the baud rate may come from autobaud
+	var sessionConfig = portConfig
+	var pendingAutobaud *autobaudRequest
+
+	// runSession : bridge an open serial port until the device goes away or the thread is killed
+	runSession := func(port io.ReadWriteCloser) error {
+		var sessionError error
+		var sessionDone = make(chan struct{})
+		var sessionOnce sync.Once
+		endSession := func(err error) {
+			sessionOnce.Do(func() {
+				sessionError = err
+				close(sessionDone)
+			})
+		}
+		sessionActive := func() bool {
+			select {
+			case <-sessionDone:
+				return false
+			default:
+				return true
+			}
+		}
+
+		var serialBuffer = make([]byte, 4096)
+		var serialBufferContentSize = 0
+
+		var serialChannel = make(chan serialItem, 1024)
+
+		var echo *echoFilter
+		if portConfig.RS485.Enabled && portConfig.RS485.SuppressEcho {
+			echo = newEchoFilter(sessionConfig)
+		}
+
+		handle := &portHandle{
+			serialPort:       port,
+			portConfig:       sessionConfig,
+			breakRequests:    make(chan breakRequest),
+			autobaudRequests: make(chan autobaudRequest),
+		}
+		m.registerPortHandle(handle)
+		defer m.unregisterPortHandle(handle)
+
+		var sessionWaitGroup sync.WaitGroup
+
+		// Signaled by the writer once the packets queued before the thread was killed are written
+		var drained = make(chan struct{})
+		// Closed when the writer has returned from its last write
+		var writerDone = make(chan struct{})
+
+		sessionWaitGroup.Add(1)
+		go func() {
+			defer sessionWaitGroup.Done()
+			select {
+			case <-ctx.Done():
+			case <-sessionDone:
+				return
+			}
+			select {
+			case <-drained:
+			case <-sessionDone:
+			case <-time.After(drainTimeout):
+				if dropped := len(udp2serialChannel); dropped > 0 {
+					m.logger(name, LogWarning, "could not write "+strconv.Itoa(dropped)+" queued packets in time, dropping them")
+					stats.LostPackets.Add(int64(dropped))
+				}
+				endSession(nil)
+				m.releaseHeldWrite(name, port, writerDone)
+			}
+			endSession(nil)
+		}()
+
+		sessionWaitGroup.Add(1)
+		go func() {
+			defer sessionWaitGroup.Done()
+			defer close(writerDone)
+			flowControl := portConfig.HardwareFlowControl || portConfig.SoftwareFlowControl
+			charTime := characterTime(sessionConfig)
+			write := func(toWrite []byte) {
+				if toWrite == nil {
+					if breakDuration <= 0 {
+						breakDuration = defaultBreakDuration
+					}
+					err := sendBreak(port, breakDuration)
+					if err != nil {
+						m.logger(name, LogWarning, err)
+					}
+					return
+				}
+				if PrintDebug {
+					fmt.Println("writing to serial port")
+				}
+				if echo != nil {
+					echo.expect(toWrite)
+				}
+				writeStart := time.Now()
+				_, err := port.Write(toWrite)
+				if flowControl {
+					// Write also waits for the line to drain the tty buffer at the
+					// baudrate, only what goes past that is the other end stopping us
+					blocked := time.Since(writeStart) - time.Duration(len(toWrite))*charTime
+					if blocked > 0 {
+						stats.FlowControlBlocked.Add(int64(blocked))
+					}
+				}
+				if err != nil {
+					endSession(err)
+				} else {
+					if PrintDebug {
+						fmt.Println("wrote to serial port")
+					}
+				}
+			}
+			for sessionActive() {
+				select {
+				case request := <-handle.breakRequests:
+					m.logger(name, LogInfo, "sending BREAK ("+request.duration.String()+")")
+					request.result <- sendBreak(port, request.duration)
+				case request := <-handle.autobaudRequests:
+					// Detection needs the tty for itself, close this session first
+					pendingAutobaud = &request
+					endSession(errAutobaudRequested)
+				case toWrite := <-udp2serialChannel:
+					write(toWrite)
+				case <-ctx.Done():
+					// Write out what was received before the kill, then let the session end
+					for sessionActive() {
+						select {
+						case toWrite := <-udp2serialChannel:
+							write(toWrite)
+							continue
+						case <-udpInputDone:
+						}
+						if len(udp2serialChannel) == 0 {
+							break
+						}
+					}
+					close(drained)
+					<-sessionDone
+				case <-sessionDone:
+				}
+			}
+			m.logger(name, LogInfo, "udpqueue2serial subthread stopped")
+		}()
+
+		sessionWaitGroup.Add(1)
+		go func() {
+			defer sessionWaitGroup.Done()
+
+			tempSerialBuffer := make([]byte, 256)
+			items := make([]serialItem, 0, 256)
+
+			var decoder *parmrkDecoder
+			if portConfig.DetectBreak {
+				decoder = &parmrkDecoder{}
+			}
+
+			for sessionActive() {
+				readLength, err := port.Read(tempSerialBuffer)
+
+				if err == io.EOF {
+					// Nothing within the inter-character timeout, or a hangup
+					if !DevicePresent(ttyName) {
+						endSession(err)
+					}
+				} else if err != nil {
+					endSession(err)
+				} else if readLength > 0 && thread.isPaused() {
+					// Keep draining the tty while paused, without forwarding
+				} else if readLength > 0 {
+					items = items[:0]
+					if decoder != nil {
+						counted := decoder.errors
+						items = decoder.decode(tempSerialBuffer[:readLength], items)
+						stats.FramingErrors.Add(int64(decoder.errors - counted))
+					} else {
+						for _, b := range tempSerialBuffer[:readLength] {
+							items = append(items, serialItem{b: b})
+						}
+					}
+					for _, item := range items {
+						if echo != nil && !item.isBreak && echo.drop(item.b) {
+							continue
+						}
+						serialChannel <- item
+					}
+				}
+			}
+			m.logger(name, LogInfo, "serialReader subthread stopped")
+		}()
+
+		sessionWaitGroup.Add(1)
+		go func() {
+			defer sessionWaitGroup.Done()
+			separator := parsePacketSeparator(portConfig.PacketSeparator)
+			breakMarker := []byte(parsePacketSeparator(portConfig.BreakMarker))
+			for {
+				packetOut := false
+				breakReceived := false
+
+				// Timeout read from serialChannel (for an incoming serial byte)
+				select {
+				case item := <-serialChannel:
+					if item.isBreak {
+						// Close the current packet, the BREAK marks a frame boundary
+						packetOut = true
+						breakReceived = true
+						break
+					}
+					incoming := item.b
+					serialBuffer[serialBufferContentSize] = incoming
+					serialBufferContentSize++
+					if serialBufferContentSize >= len(serialBuffer) {
+						packetOut = true
+					}
+					if (portConfig.PacketSeparator != "") && (string(incoming) == separator) {
+						if PrintDebug {
+							fmt.Println("Hit separator")
+						}
+						packetOut = true
+					}
+				case <-time.After(5 * time.Millisecond):
+					// If nothing arrives within the specified time, flush out the buffer to UDP
+					packetOut = true
+				}
+
+				if packetOut == true {
+					if serialBufferContentSize > 0 {
+						packet := make([]byte, serialBufferContentSize)
+						copy(packet, serialBuffer[:serialBufferContentSize])
+						serial2udpChannel <- packet
+						stats.Serial2UDPBytes.Add(int64(serialBufferContentSize))
+						serialBufferContentSize = 0
+						if PrintDebug {
+							fmt.Println("Ready out: ", packet)
+						}
+					}
+				}
+
+				if breakReceived {
+					stats.Breaks.Add(1)
+					control.send(ControlEvent{Event: "break"})
+					if len(breakMarker) > 0 {
+						serial2udpChannel <- breakMarker
+					}
+				}
+
+				if !sessionActive() && len(serialChannel) == 0 {
+					m.logger(name, LogInfo, "serial2udpqueue subthread stopped")
+					break
+				}
+			}
+		}()
+
+		sessionWaitGroup.Add(1)
+		go func() {
+			defer sessionWaitGroup.Done()
+			defer stats.Lines.Store(nil)
+
+			lines, err := getModemLines(port)
+			if err != nil {
+				m.logger(name, LogInfo, "modem lines not available: "+err.Error())
+				return
+			}
+			stats.Lines.Store(&lines)
+
+			for sessionActive() {
+				select {
+				case <-time.After(50 * time.Millisecond):
+				case <-sessionDone:
+					continue
+				}
+
+				newLines, err := getModemLines(port)
+				if err != nil || newLines == lines {
+					continue
+				}
+
+				changed := changedLines(lines, newLines)
+				if lines.CTS != newLines.CTS || lines.DSR != newLines.DSR || lines.DCD != newLines.DCD || lines.RI != newLines.RI {
+					m.logger(name, LogInfo, "modem lines changed: "+newLines.String())
+				}
+				lines = newLines
+				stats.Lines.Store(&newLines)
+
+				control.send(ControlEvent{Event: "lines", Lines: &newLines, Changed: changed})
+			}
+			m.logger(name, LogInfo, "lines monitor subthread stopped")
+		}()
+
+		<-sessionDone
+		sessionWaitGroup.Wait()
+
+		return sessionError
+	}
+
+	// Serial port sessions, reopened with the same configuration whenever the device comes back
+	var lastOpenError string
+	for ctx.Err() == nil {
+		if ttyName == "" || !DevicePresent(ttyName) {
+			stats.State.set(name, PortStateWaitingForDevice)
+			if ttyName == "" {
+				m.logger(name, LogWarning, "no device matches the definition, waiting for device")
+			} else {
+				m.logger(name, LogWarning, ttyName+" is not present, waiting for device")
+			}
+			// The device may come back under another tty name
+			present := func() bool {
+				ttyName, err = getPortTTY(m.Definitions(), portConfig.Name, m.logger)
+				return err == nil && DevicePresent(ttyName)
+			}
+			if !waitForDevice(present, ctx.Done()) {
+				break
+			}
+			m.logger(name, LogInfo, ttyName+" appeared")
+		}
+
+		var port io.ReadWriteCloser
+		var busy *PortBusyError
+		err = nil
+
+		if portConfig.Autobaud.Enabled {
+			stats.State.set(name, PortStateDetectingBaudRate)
+			var result AutobaudResult
+			result, err = detectBaudRate(ttyName, portConfig, m.Definitions().BaudRates, portConfig.Autobaud, m.logger)
+			if errors.As(err, &busy) {
+				// Reported below like any other open error
+			} else if err != nil {
+				m.logger(name, LogWarning, "baudrate detection failed, using "+strconv.Itoa(portConfig.BaudRate)+": "+err.Error())
+				sessionConfig.BaudRate = portConfig.BaudRate
+				err = nil
+			} else {
+				m.logger(name, LogInfo, "detected baudrate "+strconv.Itoa(result.BaudRate))
+				sessionConfig.BaudRate = result.BaudRate
+			}
+		}
+
+		// Open serial port
+		if err == nil {
+			err = m.Definitions().CheckBaudRate(sessionConfig.BaudRate)
+		}
+		if err == nil {
+			port, err = openSerialPort(ttyName, sessionConfig, m.logger)
+		}
+		if err != nil {
+			stats.State.setError(err)
+			if errors.As(err, &busy) {
+				stats.State.set(name, PortStateBusy)
+			} else {
+				stats.State.set(name, PortStateRetrying)
+			}
+			if err.Error() != lastOpenError {
+				m.logger(name, LogError, err)
+				lastOpenError = err.Error()
+			}
+			stats.Errors.Add(1)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		lastOpenError = ""
+		m.logger(name, LogInfo, "Opened "+ttyName)
+
+		serialPortMutex.Lock()
+		serialPort = port
+		serialPortMutex.Unlock()
+
+		// Drivers round arbitrary baudrates to what their clock can generate
+		stats.BaudRate.Store(int64(sessionConfig.BaudRate))
+		if actual, err := getBaudRate(port); err == nil {
+			stats.BaudRate.Store(int64(actual))
+			if actual != sessionConfig.BaudRate {
+				m.logger(name, LogWarning, "requested baudrate "+strconv.Itoa(sessionConfig.BaudRate)+", the driver set "+strconv.Itoa(actual))
+			}
+		}
+
+		if thread.isPaused() {
+			stats.State.set(name, PortStatePaused)
+		} else {
+			stats.State.set(name, PortStateRunning)
+		}
+		err = runSession(port)
+
+		serialPortMutex.Lock()
+		serialPort = nil
+		port.Close()
+		serialPortMutex.Unlock()
+
+		if pendingAutobaud != nil {
+			request := pendingAutobaud
+			pendingAutobaud = nil
+
+			if ctx.Err() != nil {
+				request.result <- autobaudResponse{AutobaudResult{}, errors.New("port stopped")}
+				break
+			}
+
+			m.logger(name, LogInfo, "detecting baudrate")
+			stats.State.set(name, PortStateDetectingBaudRate)
+			result, err := detectBaudRate(ttyName, sessionConfig, m.Definitions().BaudRates, request.options, m.logger)
+			request.result <- autobaudResponse{result, err}
+			continue
+		}
+
+		if ctx.Err() == nil {
+			stats.State.set(name, PortStateWaitingForDevice)
+			if err != nil {
+				stats.State.setError(err)
+				m.logger(name, LogWarning, "lost "+ttyName+": "+err.Error())
+			} else {
+				m.logger(name, LogWarning, "lost "+ttyName)
+			}
+		}
+	}
+
+	close(sessionsOver)
+	senderWaitGroup.Wait()
+	internalWaitGroup.Wait()
+
+	m.logger(name, LogWarning, "Thread reached end")
+}
@@ -0,0 +1,56 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readQueuedUDP : pass to handle the datagrams already in the socket buffer, without waiting for
+// more; a sender that keeps going can only hold it up to drainTimeout
+func readQueuedUDP(conn *net.UDPConn, buffer []byte, handle func(length int)) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var readErr error
+	err = rawConn.Control(func(fd uintptr) {
+		for start := time.Now(); time.Since(start) < drainTimeout; {
+			readLength, _, err := unix.Recvfrom(int(fd), buffer, unix.MSG_DONTWAIT)
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				if err != unix.EAGAIN {
+					readErr = err
+				}
+				return
+			}
+			handle(readLength)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// readQueuedUDP : without a non-blocking read, take what arrives within udpDrainIdle
+func readQueuedUDP(conn *net.UDPConn, buffer []byte, handle func(length int)) error {
+	conn.SetReadDeadline(time.Now().Add(udpDrainIdle))
+	for {
+		readLength, _, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		handle(readLength)
+	}
+}
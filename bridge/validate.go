@@ -0,0 +1,204 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bridge
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldError : a problem with one field of a port configuration
+type FieldError struct {
+	Port string `json:"port"`
+	// JSON name of the field, nested fields are separated by dots
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (err FieldError) Error() string {
+	if err.Port == "" {
+		return err.Field + ": " + err.Message
+	}
+	return "port " + err.Port + ": " + err.Field + ": " + err.Message
+}
+
+// ValidationError : every problem found in a configuration
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (err *ValidationError) Error() string {
+	var messages []string
+	for _, fieldError := range err.Errors {
+		messages = append(messages, fieldError.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add : record a problem with a field
+func (err *ValidationError) add(port string, field string, message string) {
+	err.Errors = append(err.Errors, FieldError{port, field, message})
+}
+
+// result : the error to return, nil when no problem was found
+func (err *ValidationError) result() error {
+	if len(err.Errors) == 0 {
+		return nil
+	}
+	return err
+}
+
+// validHost : an IP address or a host name
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (portConfig PortConfig) validate(definitions Definitions, result *ValidationError) {
+	name := portConfig.Name
+
+	if name == "" {
+		result.add(name, "name", "is empty")
+	} else if _, found := definitions.Find(name); !found {
+		result.add(name, "name", "is not in the definitions")
+	}
+
+	if err := definitions.CheckBaudRate(portConfig.BaudRate); err != nil {
+		result.add(name, "baudrate", err.Error())
+	}
+	if portConfig.DataBits < 5 || portConfig.DataBits > 8 {
+		result.add(name, "databits", "must be between 5 and 8")
+	}
+	if portConfig.StopBits != 1 && portConfig.StopBits != 2 {
+		result.add(name, "stopbits", "must be 1 or 2")
+	}
+
+	// An empty input IP listens on every address
+	if portConfig.UDPInputIP != "" && !validHost(portConfig.UDPInputIP) {
+		result.add(name, "udpInputIP", "is not an IP address or a host name")
+	}
+	if portConfig.UDPInputPort < 1 || portConfig.UDPInputPort > 65535 {
+		result.add(name, "udpInputPort", "must be between 1 and 65535")
+	}
+	if portConfig.UDPOutputIP == "" {
+		result.add(name, "udpOutputIP", "is empty")
+	} else if !validHost(portConfig.UDPOutputIP) {
+		result.add(name, "udpOutputIP", "is not an IP address or a host name")
+	}
+	if portConfig.UDPOutputPort < 1 || portConfig.UDPOutputPort > 65535 {
+		result.add(name, "udpOutputPort", "must be between 1 and 65535")
+	}
+
+	if portConfig.ControlOutputIP != "" && !validHost(portConfig.ControlOutputIP) {
+		result.add(name, "controlOutputIP", "is not an IP address or a host name")
+	}
+	if portConfig.ControlOutputPort < 0 || portConfig.ControlOutputPort > 65535 {
+		result.add(name, "controlOutputPort", "must be between 0 (disabled) and 65535")
+	}
+
+	if portConfig.BreakDuration < 0 {
+		result.add(name, "breakDuration", "cannot be negative")
+	}
+	if portConfig.RS485.DelayBeforeSend < 0 {
+		result.add(name, "rs485.delayBeforeSend", "cannot be negative")
+	}
+	if portConfig.RS485.DelayAfterSend < 0 {
+		result.add(name, "rs485.delayAfterSend", "cannot be negative")
+	}
+
+	if portConfig.Autobaud.Listen < 0 {
+		result.add(name, "autobaud.listen", "cannot be negative")
+	}
+	if portConfig.Autobaud.Expect != "" {
+		if _, err := regexp.Compile(portConfig.Autobaud.Expect); err != nil {
+			result.add(name, "autobaud.expect", err.Error())
+		}
+	}
+}
+
+// Validate : check every field of a port configuration against the definitions,
+// returns a *ValidationError listing the problems
+func (portConfig PortConfig) Validate(definitions Definitions) error {
+	result := &ValidationError{}
+	portConfig.validate(definitions, result)
+	return result.result()
+}
+
+// listenHost : the address an input IP listens on, for comparing sockets
+func listenHost(ip string) string {
+	switch ip {
+	case "", "0.0.0.0", "::":
+		return ""
+	case "localhost":
+		return "127.0.0.1"
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// Validate : check every port of a configuration against the definitions, and the ports
+// against each other; returns a *ValidationError listing the problems
+func (config Config) Validate(definitions Definitions) error {
+	result := &ValidationError{}
+
+	names := make(map[string]bool)
+	for i, portConfig := range config.Ports {
+		portConfig.validate(definitions, result)
+
+		if portConfig.Name != "" && names[portConfig.Name] {
+			result.add(portConfig.Name, "name", "is used by more than one port")
+		}
+		names[portConfig.Name] = true
+
+		// Two sockets on the same port conflict when the addresses are the same or one is a wildcard
+		for _, other := range config.Ports[:i] {
+			if other.UDPInputPort != portConfig.UDPInputPort {
+				continue
+			}
+			host, otherHost := listenHost(portConfig.UDPInputIP), listenHost(other.UDPInputIP)
+			if host == otherHost || host == "" || otherHost == "" {
+				result.add(portConfig.Name, "udpInputPort", "listen socket "+portConfig.UDPInputIP+":"+
+					strconv.Itoa(portConfig.UDPInputPort)+" conflicts with port "+other.Name)
+				break
+			}
+		}
+	}
+
+	return result.result()
+}
@@ -0,0 +1,251 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+const usage = `usage: udpserial [options] [command]
+
+Without a command, runs the daemon. Options can also be given after the command.
+
+Commands:
+  check    validate definitions.json and config.json, resolve the ttys and try to bind
+           the UDP sockets; exits non-zero on problems, without starting the daemon
+  print    print the effective configuration: options, definitions and ports merged
+`
+
+// runCommand : run a command given on the command line instead of the daemon,
+// returns the exit status
+func runCommand(command string, args []string) int {
+	switch command {
+	case "check":
+		return runCheck()
+	case "print":
+		return runPrint()
+	case "help":
+		flags := newFlagSet("udpserial")
+		flags.SetOutput(os.Stdout)
+		flags.Usage()
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, "unknown command "+command+"\n\n"+usage)
+	return 2
+}
+
+// loadFiles : read and validate the definitions and the configuration for a command,
+// printing the problems; false when they cannot be used at all
+func loadFiles() (bridge.Definitions, bridge.Config, bool) {
+	definitions, err := loadDefinitions(definitionsFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, definitionsFilename+": "+err.Error())
+		return bridge.Definitions{}, bridge.Config{}, false
+	}
+
+	config, warnings, err := loadConfig(configFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return bridge.Definitions{}, bridge.Config{}, false
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, configFilename+": warning: "+warning)
+	}
+
+	return definitions, config, true
+}
+
+// runCheck : validate the definitions and the configuration, then check them against the
+// system: every tty must resolve to a device and every UDP socket must be free; prints every
+// problem found
+func runCheck() int {
+	definitions, config, ok := loadFiles()
+	if !ok {
+		return 1
+	}
+
+	var problems []bridge.FieldError
+
+	// Ports with invalid fields are not checked further, their problems would only repeat
+	invalidPorts := make(map[string]bool)
+	err := config.Validate(definitions)
+	var invalid *bridge.ValidationError
+	if errors.As(err, &invalid) {
+		for _, fieldError := range invalid.Errors {
+			problems = append(problems, fieldError)
+			invalidPorts[fieldError.Port] = true
+		}
+	}
+
+	// Not run, only used to resolve the definitions
+	checker := bridge.NewManager(definitions, config, bridge.Options{})
+
+	for _, portConfig := range config.Ports {
+		if invalidPorts[portConfig.Name] {
+			continue
+		}
+		problems = append(problems, checkPortTTY(checker, definitions, portConfig)...)
+		problems = append(problems, checkPortSockets(portConfig)...)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, configFilename+": "+problem.Error())
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, strconv.Itoa(len(problems))+" problems found")
+		return 1
+	}
+
+	fmt.Println(configFilename + ": " + strconv.Itoa(len(config.Ports)) + " ports, no problems found")
+	return 0
+}
+
+// checkPortTTY : the definition of a port must resolve to a tty present on the system
+func checkPortTTY(checker *bridge.Manager, definitions bridge.Definitions, portConfig bridge.PortConfig) []bridge.FieldError {
+	index, _ := definitions.Find(portConfig.Name)
+	portDefinition := definitions.PortDefinitions[index]
+
+	tty, err := checker.ResolvePortDefinition(portDefinition)
+	if err != nil {
+		return []bridge.FieldError{{Port: portConfig.Name, Field: "tty", Message: err.Error()}}
+	}
+	if !bridge.DevicePresent(tty) {
+		return []bridge.FieldError{{Port: portConfig.Name, Field: "tty", Message: tty + " is not present"}}
+	}
+	return nil
+}
+
+// checkPortSockets : the input socket of a port must be free, and its output addresses must resolve
+func checkPortSockets(portConfig bridge.PortConfig) []bridge.FieldError {
+	var problems []bridge.FieldError
+	problem := func(field string, message string) {
+		problems = append(problems, bridge.FieldError{Port: portConfig.Name, Field: field, Message: message})
+	}
+
+	input := net.JoinHostPort(portConfig.UDPInputIP, strconv.Itoa(portConfig.UDPInputPort))
+	if address, err := net.ResolveUDPAddr("udp", input); err != nil {
+		problem("udpInputIP", err.Error())
+	} else if conn, err := net.ListenUDP("udp", address); err != nil {
+		message := err.Error()
+		if errors.Is(err, syscall.EADDRINUSE) {
+			message += " (is udpserial already running?)"
+		}
+		problem("udpInputPort", message)
+	} else {
+		conn.Close()
+	}
+
+	output := net.JoinHostPort(portConfig.UDPOutputIP, strconv.Itoa(portConfig.UDPOutputPort))
+	if _, err := net.ResolveUDPAddr("udp", output); err != nil {
+		problem("udpOutputIP", err.Error())
+	}
+
+	if portConfig.ControlOutputPort != 0 {
+		control := net.JoinHostPort(portConfig.ControlOutputIP, strconv.Itoa(portConfig.ControlOutputPort))
+		if _, err := net.ResolveUDPAddr("udp", control); err != nil {
+			problem("controlOutputIP", err.Error())
+		}
+	}
+
+	return problems
+}
+
+// effectivePort : a port configuration with its definition and the tty it resolves to now
+type effectivePort struct {
+	bridge.PortConfig
+	Definition *bridge.PortDefinition `json:"definition"`
+	TTY        string                 `json:"tty,omitempty"`
+}
+
+// runPrint : print the configuration the daemon would run with, after the migrations and
+// with the definition of each port
+func runPrint() int {
+	definitions, config, ok := loadFiles()
+	if !ok {
+		return 1
+	}
+
+	checker := bridge.NewManager(definitions, config, bridge.Options{})
+
+	ports := []effectivePort{}
+	for _, portConfig := range config.Ports {
+		port := effectivePort{PortConfig: portConfig}
+		if index, found := definitions.Find(portConfig.Name); found {
+			port.Definition = &definitions.PortDefinitions[index]
+			port.TTY, _ = checker.ResolvePortDefinition(*port.Definition)
+		}
+		ports = append(ports, port)
+	}
+
+	effective := struct {
+		Options struct {
+			Definitions string `json:"definitions"`
+			Config      string `json:"config"`
+			Log         string `json:"log"`
+			Panel       string `json:"panel"`
+			Listen      string `json:"listen"`
+			WebPanel    bool   `json:"webPanel"`
+		} `json:"options"`
+		Version              int             `json:"version"`
+		BaudRates            []int           `json:"baudrates"`
+		AllowCustomBaudRates bool            `json:"allowCustomBaudrates"`
+		Ports                []effectivePort `json:"ports"`
+	}{
+		Version:              config.Version,
+		BaudRates:            definitions.BaudRates,
+		AllowCustomBaudRates: definitions.AllowCustomBaudRates,
+		Ports:                ports,
+	}
+	effective.Options.Definitions = definitionsFilename
+	effective.Options.Config = configFilename
+	effective.Options.Log = logFilename
+	effective.Options.Panel = panelDirectory
+	effective.Options.Listen = webPanelListen
+	effective.Options.WebPanel = !headless
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(effective); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// logValidationError : log every problem found in a configuration
+func logValidationError(err error) {
+	var invalid *bridge.ValidationError
+	if !errors.As(err, &invalid) {
+		logger("config", LogError, err)
+		return
+	}
+	for _, fieldError := range invalid.Errors {
+		logger("config", LogError, fieldError.Error())
+	}
+}
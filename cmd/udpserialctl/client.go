@@ -0,0 +1,170 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// requestTimeout : how long a request to the daemon may take, autobaud and applies included
+const requestTimeout = 30 * time.Second
+
+// client : talks to the API of a running daemon
+type client struct {
+	http *http.Client
+	base string
+}
+
+// apiError : an error answered by the daemon
+type apiError struct {
+	Status  int
+	Message string
+	// the field problems of a configuration that did not validate
+	Errors []bridge.FieldError
+}
+
+func (err *apiError) Error() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	return "the daemon answered " + strconv.Itoa(err.Status) + " " + http.StatusText(err.Status)
+}
+
+// errNotFound : the daemon has no such port, its older endpoints answer null instead of an error
+var errNotFound = errors.New("not found")
+
+// newClient : client for the address the daemon listens on, in the same forms as its --listen
+// option (host:port, :port or unix:<path>), or a full http:// URL
+func newClient(address string) (*client, error) {
+	c := &client{http: &http.Client{Timeout: requestTimeout}}
+
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+		// The host is not used to connect
+		c.base = "http://udpserial"
+		return c, nil
+	}
+
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		c.base = strings.TrimSuffix(address, "/")
+		return c, nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.New("invalid daemon address " + address + ": " + err.Error())
+	}
+	// The daemon listens on every address by default
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	c.base = "http://" + net.JoinHostPort(host, port)
+	return c, nil
+}
+
+// request : send a request with an optional JSON body, and return the answer body
+func (c *client) request(method string, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	answer, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 300 {
+		failure := &apiError{Status: response.StatusCode}
+		var decoded struct {
+			Error  string              `json:"error"`
+			Errors []bridge.FieldError `json:"errors"`
+		}
+		if json.Unmarshal(answer, &decoded) == nil {
+			failure.Message = decoded.Error
+			failure.Errors = decoded.Errors
+		}
+		return nil, failure
+	}
+
+	return answer, nil
+}
+
+// get : GET a JSON document into result
+func (c *client) get(path string, result interface{}) error {
+	return c.call("GET", path, nil, result)
+}
+
+// call : send a request and decode the JSON answer into result, unless it is nil;
+// an answer of null is errNotFound
+func (c *client) call(method string, path string, body interface{}, result interface{}) error {
+	answer, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(answer)) == "null" {
+		return errNotFound
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(answer, result)
+}
+
+// portPath : path of a port endpoint
+func portPath(portName string, suffix string) string {
+	return "/api/ports/" + url.PathEscape(portName) + suffix
+}
@@ -0,0 +1,168 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// udpserialctl controls a running udpserial daemon through its API, for when the web
+// panel is out of reach
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+const usage = `usage: udpserialctl [options] command [arguments]
+
+Commands:
+  list                           ports of the configuration, with their state
+  show PORT                      configuration and status of a port
+  add PORT [FIELD=VALUE...]      add a port, fields not given take the web panel defaults
+  edit PORT FIELD=VALUE...       change fields of a port
+  delete PORT                    remove a port
+  pending                        changes not applied yet
+  apply [-dry-run] [-confirm N]  apply the configuration, rolled back after N seconds
+                                 unless confirmed
+  confirm                        keep an applied configuration that has to be confirmed
+  discard                        throw away the changes not applied yet
+  stats [-interval D] [-count N] live statistics of the ports, like top
+  logs [-n N] [-f]               last lines of the daemon log, -f to follow it
+
+FIELD is the JSON name of a port setting, e.g. baudrate=9600 or rs485.enabled=true;
+VALUE is read as JSON when it is valid JSON, as a string otherwise.
+
+Options:
+`
+
+// jsonOutput : print the answers of the daemon as JSON, for scripts
+var jsonOutput bool
+
+// command : a command of the client, returns the error to report
+type command func(c *client, args []string) error
+
+var commands = map[string]command{
+	"list":    commandList,
+	"show":    commandShow,
+	"add":     commandAdd,
+	"edit":    commandEdit,
+	"delete":  commandDelete,
+	"pending": commandPending,
+	"apply":   commandApply,
+	"confirm": commandConfirm,
+	"discard": commandDiscard,
+	"stats":   commandStats,
+	"logs":    commandLogs,
+}
+
+func main() {
+	flags := flag.NewFlagSet("udpserialctl", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	address := ":8080"
+	if env, found := os.LookupEnv("UDPSERIAL_LISTEN"); found {
+		address = env
+	}
+	flags.StringVar(&address, "address", address,
+		"address of the daemon: host:port, unix:<path> or an http:// URL (UDPSERIAL_LISTEN)")
+	flags.BoolVar(&jsonOutput, "json", false, "print JSON instead of text")
+
+	err := flags.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	run, found := commands[flags.Arg(0)]
+	if !found {
+		fmt.Fprintln(os.Stderr, "unknown command "+flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// --json is also accepted after the command
+	var args []string
+	for _, arg := range flags.Args()[1:] {
+		if arg == "-json" || arg == "--json" {
+			jsonOutput = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+
+	err = run(c, args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		reportError(err)
+		os.Exit(1)
+	}
+}
+
+// reportError : print an error, with every field problem of a configuration that did not validate
+func reportError(err error) {
+	var failure *apiError
+	if jsonOutput && errors.As(err, &failure) {
+		json.NewEncoder(os.Stderr).Encode(map[string]interface{}{"error": failure.Error(), "errors": failure.Errors})
+		return
+	}
+
+	if errors.As(err, &failure) && len(failure.Errors) > 0 {
+		fmt.Fprintln(os.Stderr, "udpserialctl: the configuration is not valid:")
+		for _, fieldError := range failure.Errors {
+			fmt.Fprintln(os.Stderr, "  "+fieldError.Error())
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "udpserialctl: "+err.Error())
+}
+
+// printJSON : print a value as indented JSON
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// sortedKeys : keys of a map, in order
+func sortedKeys(values map[string]interface{}) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,415 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// configChanges : differences between the running and the candidate configuration,
+// as answered by /api/config/pending
+type configChanges struct {
+	Pending   bool       `json:"pending"`
+	Added     []string   `json:"added"`
+	Removed   []string   `json:"removed"`
+	Changed   []string   `json:"changed"`
+	Unchanged []string   `json:"unchanged"`
+	ConfirmBy *time.Time `json:"confirmBy,omitempty"`
+	Fields    []struct {
+		Port   string      `json:"port"`
+		Field  string      `json:"field"`
+		Before interface{} `json:"before"`
+		After  interface{} `json:"after"`
+	} `json:"fields"`
+}
+
+// portDefaults : settings of a new port, the same as in the web panel
+func portDefaults(portName string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                portName,
+		"baudrate":            115200,
+		"databits":            8,
+		"stopbits":            1,
+		"packetSeparator":     "",
+		"udpInputIP":          "0.0.0.0",
+		"udpInputPort":        5000,
+		"udpOutputIP":         "localhost",
+		"udpOutputPort":       5000,
+		"controlOutputIP":     "",
+		"controlOutputPort":   0,
+		"hardwareFlowControl": false,
+		"softwareFlowControl": false,
+		"breakMessage":        "",
+		"breakDuration":       250,
+		"detectBreak":         false,
+		"breakMarker":         "",
+		"rs485": map[string]interface{}{
+			"enabled":         false,
+			"invertRTS":       false,
+			"delayBeforeSend": 0,
+			"delayAfterSend":  0,
+			"suppressEcho":    false,
+		},
+	}
+}
+
+// setFields : apply FIELD=VALUE arguments to a port configuration, nested fields are
+// separated by dots; a value is decoded as JSON when it is valid JSON
+func setFields(portConfig map[string]interface{}, assignments []string) error {
+	for _, assignment := range assignments {
+		field, raw, found := strings.Cut(assignment, "=")
+		if !found || field == "" {
+			return errors.New("expected FIELD=VALUE, got " + assignment)
+		}
+
+		var value interface{}
+		if json.Unmarshal([]byte(raw), &value) != nil {
+			value = raw
+		}
+
+		object := portConfig
+		path := strings.Split(field, ".")
+		for _, key := range path[:len(path)-1] {
+			nested, isObject := object[key].(map[string]interface{})
+			if !isObject {
+				nested = make(map[string]interface{})
+				object[key] = nested
+			}
+			object = nested
+		}
+		object[path[len(path)-1]] = value
+	}
+	return nil
+}
+
+// onePort : the port name argument of a command, followed by the rest of the arguments
+func onePort(args []string, name string) (string, []string, error) {
+	if len(args) == 0 || args[0] == "" {
+		return "", nil, errors.New(name + ": missing port name")
+	}
+	return args[0], args[1:], nil
+}
+
+func commandList(c *client, args []string) error {
+	var candidate, running bridge.Config
+	var statistics bridge.PublicStatistics
+	var changes configChanges
+
+	if err := c.get("/api/config/candidate", &candidate); err != nil {
+		return err
+	}
+	if err := c.get("/api/config/running", &running); err != nil {
+		return err
+	}
+	if err := c.get("/api/statistics", &statistics); err != nil {
+		return err
+	}
+	if err := c.get("/api/config/pending", &changes); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(struct {
+			Ports      []bridge.PortConfig                    `json:"ports"`
+			Statistics map[string]bridge.PublicPortStatistics `json:"statistics"`
+			Pending    configChanges                          `json:"pending"`
+		}{candidate.Ports, statistics.Ports, changes})
+	}
+
+	change := make(map[string]string)
+	for _, portName := range changes.Added {
+		change[portName] = "added"
+	}
+	for _, portName := range changes.Changed {
+		change[portName] = "changed"
+	}
+
+	// Ports removed from the candidate are still running until applied
+	ports := candidate.Ports
+	for _, portName := range changes.Removed {
+		if portConfig, err := running.Port(portName); err == nil {
+			ports = append(ports, portConfig)
+			change[portName] = "removed"
+		}
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tSTATE\tBAUDRATE\tFORMAT\tINPUT\tOUTPUT\tPENDING")
+	for _, portConfig := range ports {
+		state := "-"
+		if portStatistics, found := statistics.Ports[portConfig.Name]; found {
+			state = portStatistics.State
+		}
+		fmt.Fprintln(table, strings.Join([]string{
+			portConfig.Name,
+			state,
+			strconv.Itoa(portConfig.BaudRate),
+			strconv.Itoa(portConfig.DataBits) + "N" + strconv.Itoa(portConfig.StopBits),
+			net.JoinHostPort(portConfig.UDPInputIP, strconv.Itoa(portConfig.UDPInputPort)),
+			net.JoinHostPort(portConfig.UDPOutputIP, strconv.Itoa(portConfig.UDPOutputPort)),
+			change[portConfig.Name],
+		}, "\t"))
+	}
+	return table.Flush()
+}
+
+func commandShow(c *client, args []string) error {
+	portName, _, err := onePort(args, "show")
+	if err != nil {
+		return err
+	}
+
+	var portConfig map[string]interface{}
+	err = c.get(portPath(portName, ""), &portConfig)
+	if err == errNotFound {
+		return errors.New("no such port " + portName)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A port that is not running has no status
+	var status *bridge.PortStatus
+	if err := c.get(portPath(portName, "/status"), &status); err != nil {
+		var failure *apiError
+		if !errors.As(err, &failure) || failure.Status != 404 {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		return printJSON(struct {
+			Config map[string]interface{} `json:"config"`
+			Status *bridge.PortStatus     `json:"status,omitempty"`
+		}{portConfig, status})
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	printFields(table, portConfig, "")
+	if status == nil {
+		fmt.Fprintln(table, "state\tnot running")
+	} else {
+		fmt.Fprintln(table, "state\t"+status.State+" since "+status.Since.Local().Format(time.RFC3339))
+		fmt.Fprintln(table, "restarts\t"+strconv.Itoa(status.Restarts))
+		if status.LastError != "" {
+			fmt.Fprintln(table, "last error\t"+status.LastError)
+		}
+	}
+	return table.Flush()
+}
+
+// printFields : print the fields of a JSON object one per line, nested fields with dotted names
+func printFields(table *tabwriter.Writer, object map[string]interface{}, prefix string) {
+	for _, key := range sortedKeys(object) {
+		if nested, isObject := object[key].(map[string]interface{}); isObject {
+			printFields(table, nested, prefix+key+".")
+			continue
+		}
+		value, _ := json.Marshal(object[key])
+		fmt.Fprintln(table, prefix+key+"\t"+string(value))
+	}
+}
+
+func commandAdd(c *client, args []string) error {
+	portName, assignments, err := onePort(args, "add")
+	if err != nil {
+		return err
+	}
+
+	portConfig := portDefaults(portName)
+	if err := setFields(portConfig, assignments); err != nil {
+		return err
+	}
+
+	var added map[string]interface{}
+	if err := c.call("POST", "/api/ports", portConfig, &added); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(added)
+	}
+	fmt.Println("added port " + portName + ", apply the configuration to start it")
+	return nil
+}
+
+func commandEdit(c *client, args []string) error {
+	portName, assignments, err := onePort(args, "edit")
+	if err != nil {
+		return err
+	}
+	if len(assignments) == 0 {
+		return errors.New("edit: nothing to change")
+	}
+
+	var portConfig map[string]interface{}
+	err = c.get(portPath(portName, ""), &portConfig)
+	if err == errNotFound {
+		return errors.New("no such port " + portName)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := setFields(portConfig, assignments); err != nil {
+		return err
+	}
+	if portConfig["name"] != portName {
+		return errors.New("edit: a port cannot be renamed, delete it and add it again")
+	}
+
+	var changed map[string]interface{}
+	if err := c.call("PUT", portPath(portName, ""), portConfig, &changed); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(changed)
+	}
+	fmt.Println("changed port " + portName + ", apply the configuration to use the changes")
+	return nil
+}
+
+func commandDelete(c *client, args []string) error {
+	portName, _, err := onePort(args, "delete")
+	if err != nil {
+		return err
+	}
+
+	var deleted map[string]interface{}
+	err = c.call("DELETE", portPath(portName, ""), nil, &deleted)
+	if err == errNotFound {
+		return errors.New("no such port " + portName)
+	}
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(deleted)
+	}
+	fmt.Println("deleted port " + portName + ", apply the configuration to stop it")
+	return nil
+}
+
+func commandPending(c *client, args []string) error {
+	var changes configChanges
+	if err := c.get("/api/config/pending", &changes); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(changes)
+	}
+
+	if !changes.Pending {
+		fmt.Println("no pending changes")
+	}
+	for _, portName := range changes.Added {
+		fmt.Println("+ " + portName)
+	}
+	for _, portName := range changes.Removed {
+		fmt.Println("- " + portName)
+	}
+	for _, field := range changes.Fields {
+		before, _ := json.Marshal(field.Before)
+		after, _ := json.Marshal(field.After)
+		fmt.Println("~ " + field.Port + " " + field.Field + ": " + string(before) + " -> " + string(after))
+	}
+	if changes.ConfirmBy != nil {
+		fmt.Println("the last apply is rolled back unless confirmed by " + changes.ConfirmBy.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func commandApply(c *client, args []string) error {
+	flags := newCommandFlags("apply")
+	dryRun := flags.Bool("dry-run", false, "only tell which ports would be affected")
+	confirm := flags.Int("confirm", 0, "roll back unless confirmed within this many `seconds`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path := "/api/config/commit?dryRun=" + strconv.FormatBool(*dryRun)
+	if *confirm > 0 {
+		path += "&confirmTimeout=" + strconv.Itoa(*confirm)
+	}
+
+	var result configChanges
+	if err := c.call("POST", path, nil, &result); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(result)
+	}
+
+	verb := "applied"
+	if *dryRun {
+		verb = "would apply"
+	}
+	fmt.Println(verb + ": " + portList("added", result.Added) + ", " + portList("removed", result.Removed) + ", " +
+		portList("changed", result.Changed) + ", " + strconv.Itoa(len(result.Unchanged)) + " unchanged")
+	if result.ConfirmBy != nil {
+		fmt.Println("run udpserialctl confirm before " + result.ConfirmBy.Local().Format(time.RFC3339) + " to keep it")
+	}
+	return nil
+}
+
+// portList : a count of ports followed by their names
+func portList(what string, portNames []string) string {
+	if len(portNames) == 0 {
+		return "0 " + what
+	}
+	return strconv.Itoa(len(portNames)) + " " + what + " (" + strings.Join(portNames, ", ") + ")"
+}
+
+func commandConfirm(c *client, args []string) error {
+	if _, err := c.request("POST", "/api/config/confirm", nil); err != nil {
+		return err
+	}
+	if !jsonOutput {
+		fmt.Println("configuration confirmed")
+	}
+	return nil
+}
+
+func commandDiscard(c *client, args []string) error {
+	var config bridge.Config
+	if err := c.call("POST", "/api/config/discard", nil, &config); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(config)
+	}
+	fmt.Println("pending changes discarded")
+	return nil
+}
@@ -0,0 +1,202 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// newCommandFlags : flags of a command, parsed from the arguments following it
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: udpserialctl "+name+" [options]")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// isTerminal : whether the standard output is a terminal, which the screen can be redrawn on
+func isTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// humanBytes : a byte count with a binary unit
+func humanBytes(count int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(count)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return strconv.FormatInt(count, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[unit]
+}
+
+func commandStats(c *client, args []string) error {
+	flags := newCommandFlags("stats")
+	interval := flags.Duration("interval", time.Second, "time between two refreshes")
+	count := flags.Int("count", 0, "stop after this many refreshes, 0 to run until interrupted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("stats: the interval must be positive")
+	}
+
+	redraw := isTerminal() && !jsonOutput
+	for i := 0; *count == 0 || i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+
+		var statistics bridge.PublicStatistics
+		if err := c.get("/api/statistics", &statistics); err != nil {
+			return err
+		}
+
+		// One line per refresh, easy to pipe
+		if jsonOutput {
+			if err := json.NewEncoder(os.Stdout).Encode(statistics); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if redraw {
+			fmt.Print("\033[H\033[2J")
+		} else if i > 0 {
+			fmt.Println()
+		}
+		printStatistics(statistics)
+	}
+	return nil
+}
+
+// printStatistics : a table of the statistics of every port
+func printStatistics(statistics bridge.PublicStatistics) {
+	var names []string
+	for name := range statistics.Ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("udpserial  " + statistics.Time.Local().Format("2006-01-02 15:04:05") + "  " + strconv.Itoa(len(names)) + " ports")
+	fmt.Println()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "PORT\tSTATE\tBAUD\tUDP>SER/s\tSER>UDP/s\tUDP>SER\tSER>UDP\tLOST\tERRORS\tRESTARTS\t")
+	for _, name := range names {
+		port := statistics.Ports[name]
+		fmt.Fprintln(table, strings.Join([]string{
+			name,
+			port.State,
+			strconv.Itoa(port.BaudRate),
+			humanBytes(int64(port.UDP2SerialRate)),
+			humanBytes(int64(port.Serial2UDPRate)),
+			humanBytes(port.UDP2SerialBytes),
+			humanBytes(port.Serial2UDPBytes),
+			strconv.Itoa(port.LostPackets),
+			strconv.Itoa(port.Errors),
+			strconv.Itoa(port.Restarts),
+		}, "\t")+"\t")
+	}
+	table.Flush()
+
+	for _, name := range names {
+		if lastError := statistics.Ports[name].LastError; lastError != "" {
+			fmt.Println(name + ": " + lastError)
+		}
+	}
+}
+
+func commandLogs(c *client, args []string) error {
+	flags := newCommandFlags("logs")
+	lines := flags.Int("n", 20, "number of lines to print, 0 for the whole log")
+	follow := flags.Bool("f", false, "keep printing the lines added to the log")
+	interval := flags.Duration("interval", time.Second, "how often the log is read again with -f")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	log, err := c.request("GET", "/api/systemLog", nil)
+	if err != nil {
+		return err
+	}
+
+	text := string(log)
+	if *lines > 0 {
+		all := strings.SplitAfter(text, "\n")
+		// The log ends with a newline, which leaves an empty last element
+		if len(all) > 0 && all[len(all)-1] == "" {
+			all = all[:len(all)-1]
+		}
+		if len(all) > *lines {
+			all = all[len(all)-*lines:]
+		}
+		text = strings.Join(all, "")
+	}
+	printLog(text)
+
+	for *follow {
+		time.Sleep(*interval)
+
+		next, err := c.request("GET", "/api/systemLog", nil)
+		if err != nil {
+			return err
+		}
+		// A shorter log was started over, when the daemon restarted
+		if len(next) < len(log) || string(next[:len(log)]) != string(log) {
+			printLog(string(next))
+		} else {
+			printLog(string(next[len(log):]))
+		}
+		log = next
+	}
+	return nil
+}
+
+// printLog : print log lines, as JSON strings with --json
+func printLog(text string) {
+	if !jsonOutput {
+		fmt.Print(text)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if line != "" {
+			json.NewEncoder(os.Stdout).Encode(line)
+		}
+	}
+}
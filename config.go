@@ -23,71 +23,123 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
 )
 
-// PortConfig : structure holding a port configuration parameters
-type PortConfig struct {
-	Name            string `json:"name"`
-	BaudRate        int    `json:"baudrate"`
-	DataBits        int    `json:"databits"`
-	StopBits        int    `json:"stopbits"`
-	PacketSeparator string `json:"packetSeparator"`
-	UDPInputIP      string `json:"udpInputIP"`
-	UDPInputPort    int    `json:"udpInputPort"`
-	UDPOutputIP     string `json:"udpOutputIP"`
-	UDPOutputPort   int    `json:"udpOutputPort"`
-}
+// configFileMutex : serializes the changes to the configuration file and to its history
+var configFileMutex sync.Mutex
 
-// Config : structure holding the service configuration parameters
-type Config struct {
-	Ports []PortConfig `json:"ports"`
+// saveConfig : atomically replace the configuration file
+func saveConfig(config bridge.Config, filename string) error {
+	config.Version = bridge.ConfigVersion
+	bytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, bytes, 0644)
 }
 
-func (config *Config) toJSON() string {
-	bytes, err := config.toJSONBytes()
+// updateConfig : apply a change to the configuration file, validate it against the running
+// definitions, save it and record it in the history; source and description tell who
+// made the change and what it is. Returns the saved configuration
+func updateConfig(source string, description string, change func(config *bridge.Config) error) (bridge.Config, error) {
+	configFileMutex.Lock()
+	defer configFileMutex.Unlock()
+
+	config, err := readConfig(configFilename)
 	if err != nil {
-		return ""
+		return bridge.Config{}, err
 	}
 
-	return string(bytes)
-}
+	err = change(&config)
+	if err != nil {
+		return bridge.Config{}, err
+	}
+
+	err = config.Validate(manager.Definitions())
+	if err != nil {
+		return bridge.Config{}, err
+	}
+
+	err = saveConfig(config, configFilename)
+	if err != nil {
+		return bridge.Config{}, err
+	}
 
-func (config *Config) toJSONBytes() ([]byte, error) {
-	return json.Marshal(config)
+	err = recordConfigVersion(config, source, description)
+	if err != nil {
+		logger("config", LogWarning, "configuration saved, but not recorded in the history: "+err.Error())
+	}
+
+	return config, nil
 }
 
-func (config *Config) saveToFile(filename string) {
-	bytes, err := config.toJSONBytes()
+// openConfig : read the configuration file, creating an empty one if there is none; a file
+// from an older version is upgraded in place, after saving a backup of it. Returns the
+// warnings about unknown fields
+func openConfig(filename string) (bridge.Config, []string, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		logger("config", LogWarning, err)
+		logger("config", LogInfo, "creating empty configuration file")
+		if err := saveConfig(bridge.Config{}, filename); err != nil {
+			return bridge.Config{}, nil, err
+		}
+		return bridge.Config{Version: bridge.ConfigVersion}, nil, nil
+	}
+	if err != nil {
+		return bridge.Config{}, nil, err
+	}
+
+	config, version, warnings, err := decodeConfig(filename, raw)
 	if err != nil {
-		logger("config", LogError, err)
-	} else {
-		err := ioutil.WriteFile(filename, bytes, 0644)
-		if err != nil {
-			logger("config", LogError, err)
+		return bridge.Config{}, nil, err
+	}
+
+	if version < bridge.ConfigVersion {
+		backup := filename + ".v" + strconv.Itoa(version) + "-" + time.Now().Format("20060102T150405") + ".bak"
+		if err := writeFileAtomic(backup, raw, 0644); err != nil {
+			return bridge.Config{}, nil, errors.New("not upgrading " + filename + ", backup failed: " + err.Error())
 		}
+		if err := saveConfig(config, filename); err != nil {
+			return bridge.Config{}, nil, err
+		}
+		logger("config", LogInfo, "upgraded "+filename+" from version "+strconv.Itoa(version)+" to "+
+			strconv.Itoa(bridge.ConfigVersion)+", the previous file is saved as "+backup)
 	}
+
+	return config, warnings, nil
 }
 
-func readConfig(filename string) Config {
+// readConfig : like openConfig, for when the warnings were already reported at startup
+func readConfig(filename string) (bridge.Config, error) {
+	config, _, err := openConfig(filename)
+	return config, err
+}
+
+// loadConfig : read a configuration file, failing instead of falling back to an empty configuration;
+// an older file is upgraded in memory only. Returns the warnings about unknown fields
+func loadConfig(filename string) (bridge.Config, []string, error) {
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
-		logger("config", LogWarning, err)
-		logger("config", LogInfo, "creating empty configuration file")
-		var config = Config{}
-		config.saveToFile(filename)
-		return Config{}
+		return bridge.Config{}, nil, err
 	}
 
-	var config Config
-	json.Unmarshal(raw, &config)
-	return config
+	config, _, warnings, err := decodeConfig(filename, raw)
+	if err != nil {
+		return bridge.Config{}, nil, err
+	}
+	return config, warnings, nil
 }
 
-func getPortConfig(config Config, portname string) (PortConfig, error) {
-	for _, portConfig := range config.Ports {
-		if portConfig.Name == portname {
-			return portConfig, nil
-		}
+// logConfigWarnings : log the warnings about the fields of the configuration file
+func logConfigWarnings(warnings []string) {
+	for _, warning := range warnings {
+		logger("config", LogWarning, configFilename+": "+warning)
 	}
-	return PortConfig{}, errors.New("no such port " + portname + " in configuration file")
 }
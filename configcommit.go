@@ -0,0 +1,229 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// The candidate configuration is config.json, changed by the API; the running one is what
+// the manager runs. A commit applies the candidate, and can be made to roll back by itself
+// unless it is confirmed in time, so a change cutting off the client cannot lock it out
+
+// unconfirmedCommit : a commit that is rolled back unless confirmed in time
+type unconfirmedCommit struct {
+	// running configuration before the first unconfirmed commit
+	previous bridge.Config
+	deadline time.Time
+	timer    *time.Timer
+}
+
+// CommitResult : outcome of a commit, ConfirmBy is set when it has to be confirmed
+type CommitResult struct {
+	bridge.ConfigDiff
+	ConfirmBy *time.Time `json:"confirmBy,omitempty"`
+}
+
+var (
+	pendingCommit      *unconfirmedCommit
+	pendingCommitMutex sync.Mutex
+)
+
+// errNoUnconfirmedCommit : there is no commit waiting to be confirmed
+var errNoUnconfirmedCommit = errors.New("no commit is waiting to be confirmed")
+
+// readCandidateConfig : the configuration file, as changed through the API; only reads it,
+// the warnings about it were reported when it was loaded
+func readCandidateConfig() (bridge.Config, error) {
+	configFileMutex.Lock()
+	defer configFileMutex.Unlock()
+	config, _, err := loadConfig(configFilename)
+	return config, err
+}
+
+// commitConfig : validate and apply the candidate configuration; with a non-zero confirmTimeout
+// the running configuration is restored unless confirmCommit is called before it expires
+func commitConfig(confirmTimeout time.Duration) (CommitResult, error) {
+	return commitConfigAndDefinitions(nil, confirmTimeout)
+}
+
+// commitConfigAndDefinitions : like commitConfig, also switching to new definitions when they
+// are not nil; a commit without confirmTimeout keeps an unconfirmed one from rolling back
+func commitConfigAndDefinitions(definitions *bridge.Definitions, confirmTimeout time.Duration) (CommitResult, error) {
+	pendingCommitMutex.Lock()
+	defer pendingCommitMutex.Unlock()
+
+	candidate, err := readCandidateConfig()
+	if err != nil {
+		return CommitResult{}, err
+	}
+	validateWith := manager.Definitions()
+	if definitions != nil {
+		validateWith = *definitions
+	}
+	if err := candidate.Validate(validateWith); err != nil {
+		return CommitResult{}, err
+	}
+
+	// Another commit before the confirmation still rolls back to the last confirmed configuration
+	previous := manager.Config()
+	if pendingCommit != nil {
+		pendingCommit.timer.Stop()
+		previous = pendingCommit.previous
+		pendingCommit = nil
+		if confirmTimeout == 0 {
+			logger("config", LogInfo, "unconfirmed configuration commit superseded, it is not rolled back anymore")
+		}
+	}
+
+	var result CommitResult
+	if definitions != nil {
+		result.ConfigDiff, err = manager.Reload(candidate, *definitions)
+		if err != nil {
+			return CommitResult{}, err
+		}
+	} else {
+		result.ConfigDiff = manager.Apply(candidate)
+	}
+
+	if confirmTimeout > 0 {
+		commit := &unconfirmedCommit{
+			previous: previous,
+			deadline: time.Now().Add(confirmTimeout),
+		}
+		commit.timer = time.AfterFunc(confirmTimeout, func() { rollbackUnconfirmedCommit(commit) })
+		pendingCommit = commit
+		result.ConfirmBy = &commit.deadline
+
+		logger("config", LogInfo, "configuration committed, rolling back unless confirmed within "+confirmTimeout.String())
+	}
+
+	return result, nil
+}
+
+// confirmCommit : keep the configuration of an unconfirmed commit
+func confirmCommit() error {
+	pendingCommitMutex.Lock()
+	defer pendingCommitMutex.Unlock()
+
+	if pendingCommit == nil {
+		return errNoUnconfirmedCommit
+	}
+	pendingCommit.timer.Stop()
+	pendingCommit = nil
+
+	logger("config", LogInfo, "configuration commit confirmed")
+	return nil
+}
+
+// rollbackUnconfirmedCommit : run again the configuration running before a commit that was not
+// confirmed in time; the candidate configuration is left alone, with the edits made since
+func rollbackUnconfirmedCommit(commit *unconfirmedCommit) {
+	pendingCommitMutex.Lock()
+	defer pendingCommitMutex.Unlock()
+
+	// Confirmed, or superseded by another commit, while the timer fired
+	if pendingCommit != commit {
+		return
+	}
+	pendingCommit = nil
+
+	logger("config", LogWarning, "configuration commit not confirmed in time, rolling back the running configuration; "+
+		configFilename+" still has the changes, commit or discard them")
+
+	manager.Apply(commit.previous)
+}
+
+// restoreUnconfirmedCommit : on shutdown, put back in the configuration file the configuration
+// of an unconfirmed commit, so that it is not what the daemon starts with next time
+func restoreUnconfirmedCommit() {
+	pendingCommitMutex.Lock()
+	defer pendingCommitMutex.Unlock()
+
+	if pendingCommit == nil {
+		return
+	}
+	pendingCommit.timer.Stop()
+
+	logger("config", LogWarning, "shutting down with an unconfirmed configuration commit, restoring the previous configuration")
+	restoreConfigFile(pendingCommit.previous, "rollback", "commit not confirmed before shutdown")
+	pendingCommit = nil
+}
+
+// discardCandidateConfig : replace the candidate configuration with the running one
+func discardCandidateConfig(source string) (bridge.Config, error) {
+	running := manager.Config()
+	return updateConfig(source, "discard pending changes", func(config *bridge.Config) error {
+		*config = running
+		return nil
+	})
+}
+
+// restoreConfigFile : write a configuration that was already running back to the file,
+// without validating it again; what the file had is kept in the history
+func restoreConfigFile(config bridge.Config, source string, description string) {
+	configFileMutex.Lock()
+	defer configFileMutex.Unlock()
+
+	if overwritten, _, err := loadConfig(configFilename); err == nil && !sameConfig(overwritten, config) {
+		if err := recordConfigVersion(overwritten, source, "candidate configuration replaced"); err != nil {
+			logger("config", LogWarning, "replaced configuration not recorded in the history: "+err.Error())
+		} else {
+			logger("config", LogWarning, "replacing the candidate configuration, it is kept in the history")
+		}
+	}
+
+	if err := saveConfig(config, configFilename); err != nil {
+		logger("config", LogError, "could not restore "+configFilename+": "+err.Error())
+		return
+	}
+	if err := recordConfigVersion(config, source, description); err != nil {
+		logger("config", LogWarning, "configuration not recorded in the history: "+err.Error())
+	}
+}
+
+// pendingCommitDeadline : when the unconfirmed commit rolls back, nil when there is none
+func pendingCommitDeadline() *time.Time {
+	pendingCommitMutex.Lock()
+	defer pendingCommitMutex.Unlock()
+
+	if pendingCommit == nil {
+		return nil
+	}
+	deadline := pendingCommit.deadline
+	return &deadline
+}
+
+// parseConfirmTimeout : the confirmTimeout query parameter, in seconds
+func parseConfirmTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("confirmTimeout must be a number of seconds")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
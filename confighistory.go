@@ -0,0 +1,235 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// maxConfigVersions : how many versions of the configuration file the history keeps
+const maxConfigVersions = 20
+
+// ConfigVersion : a saved version of the configuration file
+type ConfigVersion struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	// who made the change: "startup", "signal" or "api" followed by the client address
+	Source      string         `json:"source"`
+	Description string         `json:"description"`
+	Config      *bridge.Config `json:"config,omitempty"`
+}
+
+// errNoSuchConfigVersion : the version is not (or no longer) in the history
+var errNoSuchConfigVersion = errors.New("no such version in the configuration history")
+
+// configHistoryFilename : the history is kept next to the configuration file
+func configHistoryFilename() string {
+	return configFilename + ".history"
+}
+
+// readConfigHistory : read the saved versions, oldest first; a missing history is empty
+func readConfigHistory() ([]ConfigVersion, error) {
+	raw, err := ioutil.ReadFile(configHistoryFilename())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var history []ConfigVersion
+	err = json.Unmarshal(raw, &history)
+	if err != nil {
+		return nil, errors.New(configHistoryFilename() + ": " + err.Error())
+	}
+	return history, nil
+}
+
+// recordConfigVersion : append a version to the history, dropping the oldest ones past
+// maxConfigVersions; nothing is recorded when the configuration is the same as the
+// latest version. The caller holds configFileMutex
+func recordConfigVersion(config bridge.Config, source string, description string) error {
+	history, err := readConfigHistory()
+	if err != nil {
+		return err
+	}
+
+	id := 1
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		if latest.Config != nil && sameConfig(*latest.Config, config) {
+			return nil
+		}
+		id = latest.ID + 1
+	}
+
+	history = append(history, ConfigVersion{
+		ID:          id,
+		Time:        time.Now(),
+		Source:      source,
+		Description: description,
+		Config:      &config,
+	})
+	if len(history) > maxConfigVersions {
+		history = history[len(history)-maxConfigVersions:]
+	}
+
+	raw, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(configHistoryFilename(), raw, 0644)
+}
+
+// recordCurrentConfig : record the configuration file as it is, e.g. after it was edited by hand
+func recordCurrentConfig(config bridge.Config, source string, description string) {
+	configFileMutex.Lock()
+	defer configFileMutex.Unlock()
+
+	if err := recordConfigVersion(config, source, description); err != nil {
+		logger("config", LogWarning, "configuration not recorded in the history: "+err.Error())
+	}
+}
+
+// configVersion : a version of the history by id
+func configVersion(id int) (ConfigVersion, error) {
+	configFileMutex.Lock()
+	history, err := readConfigHistory()
+	configFileMutex.Unlock()
+	if err != nil {
+		return ConfigVersion{}, err
+	}
+
+	for _, version := range history {
+		if version.ID == id && version.Config != nil {
+			return version, nil
+		}
+	}
+	return ConfigVersion{}, errNoSuchConfigVersion
+}
+
+// rollbackConfig : replace the configuration file with a version of the history,
+// the rollback is itself recorded as a new version
+func rollbackConfig(id int, source string) (bridge.Config, error) {
+	version, err := configVersion(id)
+	if err != nil {
+		return bridge.Config{}, err
+	}
+
+	return updateConfig(source, "rollback to version "+strconv.Itoa(id), func(config *bridge.Config) error {
+		*config = *version.Config
+		return nil
+	})
+}
+
+// sameConfig : whether two configurations would be saved as the same file
+func sameConfig(a bridge.Config, b bridge.Config) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(rawA, rawB)
+}
+
+// FieldChange : a field of a port configuration whose value differs between two configurations
+type FieldChange struct {
+	Port string `json:"port"`
+	// JSON name of the field, nested fields are separated by dots
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// ConfigChanges : the ports affected by replacing a configuration with another one,
+// and the fields that changed in each of the changed ports
+type ConfigChanges struct {
+	bridge.ConfigDiff
+	Fields []FieldChange `json:"fields"`
+}
+
+// diffConfigs : compare two configurations port by port and field by field
+func diffConfigs(before bridge.Config, after bridge.Config) ConfigChanges {
+	changes := ConfigChanges{
+		ConfigDiff: bridge.DiffConfig(before, after),
+		Fields:     []FieldChange{},
+	}
+
+	for _, portName := range changes.Changed {
+		beforePort, _ := before.Port(portName)
+		afterPort, _ := after.Port(portName)
+
+		beforeFields := make(map[string]interface{})
+		afterFields := make(map[string]interface{})
+		flattenFields(beforePort, "", beforeFields)
+		flattenFields(afterPort, "", afterFields)
+
+		var names []string
+		for name := range beforeFields {
+			names = append(names, name)
+		}
+		for name := range afterFields {
+			if _, found := beforeFields[name]; !found {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			beforeRaw, _ := json.Marshal(beforeFields[name])
+			afterRaw, _ := json.Marshal(afterFields[name])
+			if !bytes.Equal(beforeRaw, afterRaw) {
+				changes.Fields = append(changes.Fields, FieldChange{portName, name, beforeFields[name], afterFields[name]})
+			}
+		}
+	}
+
+	return changes
+}
+
+// flattenFields : collect the leaf values of the JSON form of a value, keyed by their dotted path
+func flattenFields(value interface{}, prefix string, fields map[string]interface{}) {
+	var decoded interface{}
+	if raw, err := json.Marshal(value); err != nil || json.Unmarshal(raw, &decoded) != nil {
+		return
+	}
+
+	object, isObject := decoded.(map[string]interface{})
+	if !isObject {
+		fields[prefix] = decoded
+		return
+	}
+	for key, field := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if _, nested := field.(map[string]interface{}); nested {
+			flattenFields(field, key, fields)
+		} else {
+			fields[key] = field
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// configMigration : upgrade the decoded JSON of a configuration by one version
+type configMigration func(config map[string]interface{}) error
+
+// configMigrations : configMigrations[n] upgrades a configuration from version n to n+1,
+// there must be one for each version below bridge.ConfigVersion
+var configMigrations = []configMigration{
+	// 0 → 1: files written before versioning. Every field added since then defaults to
+	// its zero value, which is the old behaviour, so there is nothing to change
+	func(config map[string]interface{}) error {
+		return nil
+	},
+}
+
+// decodeConfig : decode a configuration file, migrating it to the current version;
+// returns the version it was written with and a warning for each field that is not
+// part of the configuration, which would otherwise be dropped silently
+func decodeConfig(filename string, raw []byte) (bridge.Config, int, []string, error) {
+	var decoded map[string]interface{}
+	err := json.Unmarshal(raw, &decoded)
+	if err == nil && decoded == nil {
+		err = errors.New("the configuration is not a JSON object")
+	}
+	if err != nil {
+		return bridge.Config{}, 0, nil, errors.New(filename + ": " + err.Error())
+	}
+
+	version := 0
+	if value, found := decoded["version"]; found {
+		number, isNumber := value.(float64)
+		if !isNumber || number < 0 || number != math.Trunc(number) {
+			return bridge.Config{}, 0, nil, errors.New(filename + ": version must be a non-negative integer")
+		}
+		version = int(number)
+	}
+	if version > bridge.ConfigVersion {
+		return bridge.Config{}, version, nil, errors.New(filename + ": written by a newer udpserial (configuration version " +
+			strconv.Itoa(version) + ", this one supports up to " + strconv.Itoa(bridge.ConfigVersion) + ")")
+	}
+
+	for v := version; v < bridge.ConfigVersion; v++ {
+		if err := configMigrations[v](decoded); err != nil {
+			return bridge.Config{}, version, nil, errors.New(filename + ": upgrading from version " + strconv.Itoa(v) + ": " + err.Error())
+		}
+	}
+	decoded["version"] = bridge.ConfigVersion
+
+	var warnings []string
+	unknownFields(decoded, reflect.TypeOf(bridge.Config{}), "", &warnings)
+
+	migrated, err := json.Marshal(decoded)
+	if err != nil {
+		return bridge.Config{}, version, nil, err
+	}
+	var config bridge.Config
+	err = json.Unmarshal(migrated, &config)
+	if err != nil {
+		return bridge.Config{}, version, nil, errors.New(filename + ": " + err.Error())
+	}
+	return config, version, warnings, nil
+}
+
+// unknownFields : append a warning for each key of the decoded JSON that has no matching
+// field in the type it is decoded into
+func unknownFields(value interface{}, t reflect.Type, path string, warnings *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = field.Type
+		}
+
+		var keys []string
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			fieldType, found := fields[key]
+			if !found {
+				// json.Unmarshal also matches the field names case-insensitively
+				for name, candidate := range fields {
+					if strings.EqualFold(name, key) {
+						fieldType, found = candidate, true
+						break
+					}
+				}
+			}
+			if !found {
+				*warnings = append(*warnings, fieldPath+": unknown field, ignored")
+				continue
+			}
+			unknownFields(object[key], fieldType, fieldPath, warnings)
+		}
+
+	case reflect.Slice:
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return
+		}
+		for i, element := range array {
+			unknownFields(element, t.Elem(), path+"["+strconv.Itoa(i)+"]", warnings)
+		}
+	}
+}
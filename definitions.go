@@ -23,37 +23,46 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-)
 
-// PortDefinition : structure that contains information about the mapping of a port name to a tty
-type PortDefinition struct {
-	PortName string `json:"name"`
-	TTY      string `json:"tty"`
-}
+	"github.com/gdelazzari/udpserial/bridge"
+)
 
-// Definitions : structure that represents the definitions file data
-type Definitions struct {
-	PortDefinitions []PortDefinition `json:"ports"`
-	BaudRates       []int            `json:"baudrates"`
+func saveDefinitions(definitions bridge.Definitions) error {
+	bytes, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(definitionsFilename, bytes, 0644)
 }
 
-func readDefinitions(filename string) Definitions {
+// loadDefinitions : read and validate a definitions file
+func loadDefinitions(filename string) (bridge.Definitions, error) {
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
-		logger("definitions", LogFatal, err)
+		return bridge.Definitions{}, err
 	}
 
-	var definitions Definitions
-	json.Unmarshal(raw, &definitions)
-	return definitions
-}
+	var definitions bridge.Definitions
+	err = json.Unmarshal(raw, &definitions)
+	if err != nil {
+		return bridge.Definitions{}, err
+	}
 
-func getPortTTY(definitions Definitions, portname string) (string, error) {
-	for _, portDefinition := range definitions.PortDefinitions {
-		if portDefinition.PortName == portname {
-			return portDefinition.TTY, nil
-		}
+	err = definitions.Validate()
+	if err != nil {
+		return bridge.Definitions{}, err
 	}
+	return definitions, nil
+}
 
-	return "", errors.New("no such port name " + portname + " in definitions file")
+// addPortDefinition : add a port definition and save it to the definitions file
+func addPortDefinition(portDefinition bridge.PortDefinition) error {
+	_, err := manager.UpdateDefinitions(func(definitions *bridge.Definitions) error {
+		if _, found := definitions.Find(portDefinition.PortName); found {
+			return errors.New("port name " + portDefinition.PortName + " is already defined")
+		}
+		definitions.PortDefinitions = append(definitions.PortDefinitions, portDefinition)
+		return nil
+	})
+	return err
 }
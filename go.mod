@@ -3,7 +3,7 @@ module github.com/gdelazzari/udpserial
 go 1.19
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4 // indirect
-	golang.org/x/sys v0.0.0-20221006211917-84dc82d7e875 // indirect
+	github.com/gorilla/mux v1.8.0
+	github.com/jacobsa/go-serial v0.0.0-20180131005756-15cf729a72d4
+	golang.org/x/sys v0.0.0-20221006211917-84dc82d7e875
 )
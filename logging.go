@@ -24,24 +24,26 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+
+	"github.com/gdelazzari/udpserial/bridge"
 )
 
 var logFile *os.File
 
 // Log level constants
 const (
-	LogInfo    = 4
-	LogWarning = 3
-	LogError   = 2
+	LogInfo    = bridge.LogInfo
+	LogWarning = bridge.LogWarning
+	LogError   = bridge.LogError
 	LogFatal   = 1
 	LogPanic   = 0
 )
 
 func initLogger() {
 	var err error
-	_ = os.Remove("udpserial.log.bak")
-	_ = os.Rename("udpserial.log", "udpserial.log.bak")
-	logFile, err = os.OpenFile("udpserial.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	_ = os.Remove(logFilename + ".bak")
+	_ = os.Rename(logFilename, logFilename+".bak")
+	logFile, err = os.OpenFile(logFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("error opening file: %v", err)
 	}
@@ -67,7 +69,7 @@ func logger(source string, level int, content interface{}) {
 }
 
 func getLogString() string {
-	bytes, err := ioutil.ReadFile("udpserial.log")
+	bytes, err := ioutil.ReadFile(logFilename)
 	if err != nil {
 		logger("logger", LogError, err)
 		return ""
@@ -0,0 +1,128 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Paths and listeners of the daemon, set by the command line flags or by the
+// UDPSERIAL_* environment variables; relative paths are relative to the working directory
+var (
+	definitionsFilename = "definitions.json"
+	configFilename      = "config.json"
+	logFilename         = "udpserial.log"
+	panelDirectory      = "./panel/dist"
+	// a TCP address, or unix:<path> for a Unix socket
+	webPanelListen = ":8080"
+	// no web panel and no API
+	headless = false
+)
+
+// newFlagSet : flags of the daemon and of its commands, the defaults come from the
+// environment; a flag given on the command line wins over the environment
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage+"\nOptions:\n")
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&definitionsFilename, "definitions", envString("UDPSERIAL_DEFINITIONS", definitionsFilename),
+		"definitions file (UDPSERIAL_DEFINITIONS)")
+	flags.StringVar(&configFilename, "config", envString("UDPSERIAL_CONFIG", configFilename),
+		"configuration file (UDPSERIAL_CONFIG)")
+	flags.StringVar(&logFilename, "log", envString("UDPSERIAL_LOG", logFilename),
+		"log file, the previous one is kept with a .bak suffix (UDPSERIAL_LOG)")
+	flags.StringVar(&panelDirectory, "panel", envString("UDPSERIAL_PANEL", panelDirectory),
+		"directory of the built web panel (UDPSERIAL_PANEL)")
+	flags.StringVar(&webPanelListen, "listen", envString("UDPSERIAL_LISTEN", webPanelListen),
+		"address the web panel and the API listen on, or unix:<path> for a Unix socket (UDPSERIAL_LISTEN)")
+
+	flags.BoolVar(&headless, "no-webpanel", envBool("UDPSERIAL_NO_WEBPANEL", headless),
+		"run headless, without the web panel and the API (UDPSERIAL_NO_WEBPANEL)")
+
+	return flags
+}
+
+// parseCommandLine : parse the flags, which can come before and after the command;
+// the command is empty when the daemon has to run. Exits on invalid flags and -h
+func parseCommandLine(args []string) (string, []string) {
+	flags := newFlagSet("udpserial")
+
+	parse := func(args []string) {
+		err := flags.Parse(args)
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			os.Exit(2)
+		}
+	}
+
+	parse(args)
+	if flags.NArg() == 0 {
+		return "", nil
+	}
+
+	command := flags.Arg(0)
+	parse(flags.Args()[1:])
+	return command, flags.Args()
+}
+
+// envString : value of an environment variable, or a default when it is not set
+func envString(name string, value string) string {
+	if env, found := os.LookupEnv(name); found {
+		return env
+	}
+	return value
+}
+
+// envBool : boolean value of an environment variable, or a default when it is not set or not a boolean
+func envBool(name string, value bool) bool {
+	if env, found := os.LookupEnv(name); found {
+		if parsed, err := strconv.ParseBool(env); err == nil {
+			return parsed
+		}
+		fmt.Fprintln(os.Stderr, name+": not a boolean, ignored")
+	}
+	return value
+}
+
+// webPanelListener : listen on the address of the web panel, a stale Unix socket left by a
+// previous run is removed
+func webPanelListener(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		if path == "" {
+			return nil, errors.New("empty Unix socket path")
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,12 @@
+import UIkit from 'uikit'
+
+export function escapeHTML (text) {
+  return String(text).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'})[c])
+}
+
+// Shows the error of a failed API request, with every field of a validation error
+export function notifyRequestError (response) {
+  const data = response.data
+  const errors = data && data.errors ? data.errors : [{port: '', field: '', message: data && data.error ? data.error : 'request failed'}]
+  UIkit.notification(errors.map(e => (e.port ? escapeHTML(e.port) + ' ' : '') + (e.field ? '<b>' + escapeHTML(e.field) + '</b> ' : '') + escapeHTML(e.message)).join('<br>'), {pos: 'top-right', status: 'danger'});
+}
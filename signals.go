@@ -0,0 +1,73 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals : SIGTERM and SIGINT shut down gracefully, SIGHUP reloads the
+// configuration and the definitions
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			logger("main", LogInfo, "Received SIGHUP, reloading configuration and definitions")
+			sdNotify(sdReloadingState())
+			reloadConfiguration()
+			sdNotify("READY=1")
+			continue
+		}
+
+		logger("main", LogInfo, "Received "+sig.String()+", shutting down")
+		// A second signal terminates right away
+		signal.Stop(signals)
+		cancel()
+		return
+	}
+}
+
+// reloadConfiguration : reload definitions and configuration from their files, restarting only
+// the ports affected by the changes; this commits the configuration file like the API does
+func reloadConfiguration() {
+	if _, warnings, err := loadConfig(configFilename); err == nil {
+		logConfigWarnings(warnings)
+	}
+
+	newDefinitions, err := loadDefinitions(definitionsFilename)
+	if err != nil {
+		logger("main", LogError, "definitions not reloaded: "+err.Error())
+		newDefinitions = manager.Definitions()
+	}
+
+	_, err = commitConfigAndDefinitions(&newDefinitions, 0)
+	if err != nil {
+		logValidationError(err)
+		logger("main", LogError, "configuration not reloaded from "+configFilename)
+		return
+	}
+
+	recordCurrentConfig(manager.Config(), "signal", "configuration file reloaded")
+}
@@ -0,0 +1,196 @@
+/*
+  udpserial - lightweight bridge for serial ports over UDP packets
+
+  Copyright (C) 2022  Giacomo De Lazzari
+
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdelazzari/udpserial/bridge"
+)
+
+// sdNotify : send a state update to systemd through $NOTIFY_SOCKET,
+// does nothing when not started by systemd with Type=notify
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract namespace socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdReloadingState : the RELOADING=1 update, with the MONOTONIC_USEC that Type=notify-reload
+// services have to send along with it
+func sdReloadingState() string {
+	usec, err := monotonicUsec()
+	if err != nil {
+		return "RELOADING=1"
+	}
+	return "RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+}
+
+// sdWatchdogInterval : how often systemd expects a WATCHDOG=1, zero when the watchdog is disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// systemdListener : the first socket passed by systemd socket activation ($LISTEN_FDS),
+// nil when the daemon was not socket activated
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	// Not meant for child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Passed file descriptors start at 3
+	file := os.NewFile(3, "LISTEN_FD_3")
+	if file == nil {
+		return nil, errors.New("invalid socket activation file descriptor")
+	}
+	defer file.Close()
+
+	return net.FileListener(file)
+}
+
+// stablePortState : whether a port is done starting up
+func stablePortState(state string) bool {
+	return state != "" && state != bridge.PortStateStarting && state != bridge.PortStateDetectingBaudRate
+}
+
+// portsSummary : count of ports in each state, and whether they are all in a stable state
+func portsSummary() (string, bool) {
+	counts := make(map[string]int)
+	total := 0
+	stable := true
+
+	for _, port := range manager.Ports() {
+		state := port.Status().State
+		counts[state]++
+		total++
+		if !stablePortState(state) {
+			stable = false
+		}
+	}
+
+	var states []string
+	for state, count := range counts {
+		states = append(states, strconv.Itoa(count)+" "+state)
+	}
+	sort.Strings(states)
+
+	summary := strconv.Itoa(total) + " ports"
+	if len(states) > 0 {
+		summary += ": " + strings.Join(states, ", ")
+	}
+	return summary, stable
+}
+
+// systemdThread : readiness, watchdog and status notifications to systemd
+func systemdThread(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	watchdogInterval := sdWatchdogInterval()
+	if watchdogInterval > 0 {
+		logger("systemd", LogInfo, "watchdog enabled, pinging every "+(watchdogInterval/2).String())
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	ready := false
+	lastStatus := ""
+	lastWatchdog := time.Time{}
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			return
+		}
+
+		summary, stable := portsSummary()
+
+		// Ready once every port is either bridging or has settled in a waiting state
+		if !ready && stable {
+			ready = true
+			logger("systemd", LogInfo, "notifying readiness")
+			err := sdNotify("READY=1\nSTATUS=" + summary)
+			if err != nil {
+				logger("systemd", LogWarning, err)
+			}
+			lastStatus = summary
+		}
+
+		if summary != lastStatus {
+			sdNotify("STATUS=" + summary)
+			lastStatus = summary
+		}
+
+		// A stuck supervisor loop lets the watchdog expire, and systemd restarts us
+		if watchdogInterval > 0 && time.Since(lastWatchdog) >= watchdogInterval/2 && manager.Healthy() {
+			sdNotify("WATCHDOG=1")
+			lastWatchdog = time.Now()
+		}
+	}
+}
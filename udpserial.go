@@ -20,20 +20,23 @@
 package main
 
 import (
+	"context"
+	"os"
 	"sync"
+
+	"github.com/gdelazzari/udpserial/bridge"
 )
 
 import _ "net/http/pprof"
 
-const definitionsFilename = "definitions.json"
-const configFilename = "config.json"
-
-var definitions Definitions
-var config Config
-
-var statistics Statistics
+var manager *bridge.Manager
 
 func main() {
+	command, args := parseCommandLine(os.Args[1:])
+	if command != "" {
+		os.Exit(runCommand(command, args))
+	}
+
 	println(`udpserial  Copyright (C) 2022  Giacomo De Lazzari
 
 This program comes with ABSOLUTELY NO WARRANTY.
@@ -44,26 +47,61 @@ under certain conditions; see the provided LICENSE for details.
 	initLogger()
 	defer closeLogger()
 
-	definitions = readDefinitions(definitionsFilename)
+	definitions, err := loadDefinitions(definitionsFilename)
+	if err != nil {
+		logger("main", LogFatal, "cannot load "+definitionsFilename+": "+err.Error())
+	}
 	logger("main", LogInfo, "Loaded definitions")
 
-	config = readConfig(configFilename)
+	config, warnings, err := openConfig(configFilename)
+	if err != nil {
+		logger("main", LogFatal, err)
+	}
+	logConfigWarnings(warnings)
+	if err := config.Validate(definitions); err != nil {
+		logValidationError(err)
+		logger("main", LogFatal, "invalid configuration in "+configFilename)
+	}
 	logger("main", LogInfo, "Loaded configuration")
 
+	// Changes made by hand while we were not running become a version of their own
+	recordCurrentConfig(config, "startup", "configuration file loaded")
+
 	if len(config.Ports) <= 0 {
 		logger("main", LogWarning, "No ports configured")
 	}
 
-	var waitGroup sync.WaitGroup
+	manager = bridge.NewManager(definitions, config, bridge.Options{
+		Logger:          logger,
+		SaveDefinitions: saveDefinitions,
+	})
 
-	waitGroup.Add(1)
-	go startAndSuperviseThreads(&waitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go handleSignals(cancel)
+
+	var waitGroup sync.WaitGroup
 
 	waitGroup.Add(1)
-	go serveWebPanel(&waitGroup)
+	go func() {
+		defer waitGroup.Done()
+		manager.Run(ctx)
+	}()
+
+	if headless {
+		logger("main", LogInfo, "running without the web panel")
+	} else {
+		waitGroup.Add(1)
+		go serveWebPanel(ctx, &waitGroup)
+	}
 
 	waitGroup.Add(1)
-	go statisticsThread(&waitGroup, &statistics)
+	go systemdThread(ctx, &waitGroup)
 
 	waitGroup.Wait()
+
+	restoreUnconfirmedCommit()
+
+	logger("main", LogInfo, "Stopped")
 }
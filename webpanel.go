@@ -20,18 +20,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/gdelazzari/udpserial/bridge"
 	"github.com/gorilla/mux"
 )
 
-func serveWebPanel(wg *sync.WaitGroup) {
+// shutdownTimeout : how long the web server waits for the requests in progress when stopping
+const shutdownTimeout = 5 * time.Second
+
+func serveWebPanel(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	logger("webpanel", LogInfo, "starting web server")
@@ -43,22 +51,83 @@ func serveWebPanel(wg *sync.WaitGroup) {
 	router.HandleFunc("/api/ports", handlerPortPost).Methods("POST")
 	router.HandleFunc("/api/ports/{portName}", handlerPortPut).Methods("PUT")
 	router.HandleFunc("/api/ports/{portName}", handlerPortDelete).Methods("DELETE")
+	router.HandleFunc("/api/ports/{portName}/lines", handlerPortLinesGet).Methods("GET")
+	router.HandleFunc("/api/ports/{portName}/lines", handlerPortLinesPut).Methods("PUT")
+	router.HandleFunc("/api/ports/{portName}/break", handlerPortBreak).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/autobaud", handlerPortAutobaud).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/status", handlerPortStatus).Methods("GET")
+	router.HandleFunc("/api/ports/{portName}/start", handlerPortStart).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/stop", handlerPortStop).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/restart", handlerPortRestart).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/pause", handlerPortPause).Methods("POST")
+	router.HandleFunc("/api/ports/{portName}/resume", handlerPortResume).Methods("POST")
 	router.HandleFunc("/api/statistics", handlerStatistics).Methods("GET")
 	router.HandleFunc("/api/systemLog", handlerSystemLog).Methods("GET")
 	router.HandleFunc("/api/freePortNames", handlerFreePortNames).Methods("GET")
 	router.HandleFunc("/api/baudrates", handlerBaudrates).Methods("GET")
+	router.HandleFunc("/api/definitions", handlerDefinitionsGet).Methods("GET")
+	router.HandleFunc("/api/definitions/ports", handlerPortDefinitionsIndex).Methods("GET")
+	router.HandleFunc("/api/definitions/ports", handlerPortDefinitionPost).Methods("POST")
+	router.HandleFunc("/api/definitions/ports/{portName}", handlerPortDefinitionGet).Methods("GET")
+	router.HandleFunc("/api/definitions/ports/{portName}", handlerPortDefinitionPut).Methods("PUT")
+	router.HandleFunc("/api/definitions/ports/{portName}", handlerPortDefinitionDelete).Methods("DELETE")
+	router.HandleFunc("/api/definitions/baudrates", handlerBaudrates).Methods("GET")
+	router.HandleFunc("/api/definitions/baudrates", handlerBaudratesPut).Methods("PUT")
+	router.HandleFunc("/api/devices", handlerDevices).Methods("GET")
+	router.HandleFunc("/api/devices/{deviceName}/define", handlerDeviceDefine).Methods("POST")
 	router.HandleFunc("/api/listenIPs", handlerListenIPs).Methods("GET")
 	router.HandleFunc("/api/reloadConfigAndRestartThreads", handlerReloadConfigAndRestartThreads).Methods("GET")
-
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./panel/dist")))
+	router.HandleFunc("/api/config/apply", handlerConfigApply).Methods("POST")
+	router.HandleFunc("/api/config/candidate", handlerConfigCandidate).Methods("GET")
+	router.HandleFunc("/api/config/running", handlerConfigRunning).Methods("GET")
+	router.HandleFunc("/api/config/pending", handlerConfigPending).Methods("GET")
+	router.HandleFunc("/api/config/commit", handlerConfigApply).Methods("POST")
+	router.HandleFunc("/api/config/confirm", handlerConfigConfirm).Methods("POST")
+	router.HandleFunc("/api/config/discard", handlerConfigDiscard).Methods("POST")
+	router.HandleFunc("/api/config/history", handlerConfigHistory).Methods("GET")
+	router.HandleFunc("/api/config/history/{id:[0-9]+}", handlerConfigVersion).Methods("GET")
+	router.HandleFunc("/api/config/history/{id:[0-9]+}/diff", handlerConfigVersionDiff).Methods("GET")
+	router.HandleFunc("/api/config/history/{id:[0-9]+}/rollback", handlerConfigVersionRollback).Methods("POST")
+
+	router.PathPrefix("/").Handler(http.FileServer(http.Dir(panelDirectory)))
 
 	http.Handle("/", router)
 
-	logger("webpanel", LogFatal, http.ListenAndServe(":8080", nil))
+	server := &http.Server{}
+
+	go func() {
+		<-ctx.Done()
+		logger("webpanel", LogInfo, "stopping web server")
+		shutdownContext, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownContext)
+	}()
+
+	listener, err := systemdListener()
+	if err != nil {
+		logger("webpanel", LogFatal, err)
+	}
+	if listener != nil {
+		logger("webpanel", LogInfo, "listening on "+listener.Addr().String()+" (socket activation)")
+	} else {
+		listener, err = webPanelListener(webPanelListen)
+		if err != nil {
+			logger("webpanel", LogFatal, err)
+		}
+		logger("webpanel", LogInfo, "listening on "+webPanelListen)
+	}
+	err = server.Serve(listener)
+	if err != http.ErrServerClosed {
+		logger("webpanel", LogFatal, err)
+	}
 }
 
 func handlerPortsIndex(w http.ResponseWriter, r *http.Request) {
-	changingConfig := readConfig(configFilename)
+	changingConfig, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -74,22 +143,26 @@ func handlerPortGet(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	portName := vars["portName"]
 
-	changingConfig := readConfig(configFilename)
-
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	changingConfig, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
 
-	data, err := getPortConfig(changingConfig, portName)
+	data, err := changingConfig.Port(portName)
 	if err != nil {
 		answerError(&w)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
 	json.NewEncoder(w).Encode(data)
 }
 
 func handlerPortPost(w http.ResponseWriter, r *http.Request) {
-	var portConfig PortConfig
+	var portConfig bridge.PortConfig
 
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
@@ -109,31 +182,142 @@ func handlerPortPost(w http.ResponseWriter, r *http.Request) {
 
 	logger("webpanel", LogInfo, "posted config for port "+portConfig.Name)
 
-	changingConfig := readConfig(configFilename)
+	// A port with the same name is refused by the validation
+	_, err = updateConfig(apiSource(r), "add port "+portConfig.Name, func(config *bridge.Config) error {
+		config.Ports = append(config.Ports, portConfig)
+		return nil
+	})
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
 
-	_, getPortError := getPortConfig(changingConfig, portConfig.Name)
+	json.NewEncoder(w).Encode(portConfig)
+}
 
-	if getPortError != nil {
-		changingConfig.Ports = append(changingConfig.Ports, portConfig)
+func handlerPortPut(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
 
-		changingConfig.saveToFile(configFilename)
+	var portConfig bridge.PortConfig
 
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		answerError(&w)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		answerError(&w)
+		return
+	}
+	if err := json.Unmarshal(body, &portConfig); err != nil {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusCreated)
+		w.WriteHeader(422) // unprocessable entity
+		json.NewEncoder(w).Encode(nil)
+		return
+	}
 
-		json.NewEncoder(w).Encode(portConfig)
+	logger("webpanel", LogInfo, "changing config for port "+portConfig.Name)
+
+	if portConfig.Name != portName {
+		answerError(&w)
 		return
 	}
 
-	answerError(&w)
-	return
+	found := false
+	_, err = updateConfig(apiSource(r), "edit port "+portName, func(config *bridge.Config) error {
+		for i := range config.Ports {
+			if config.Ports[i].Name == portName {
+				config.Ports[i] = portConfig
+				found = true
+				return nil
+			}
+		}
+		return errors.New("no such port " + portName + " in configuration file")
+	})
+	if !found {
+		answerError(&w)
+		return
+	}
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(portConfig)
 }
 
-func handlerPortPut(w http.ResponseWriter, r *http.Request) {
+func handlerPortDelete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	portName := vars["portName"]
 
-	var portConfig PortConfig
+	logger("webpanel", LogInfo, "deleting config for port "+portName)
+
+	foundIdx := -1
+	foundPortConfig := bridge.PortConfig{}
+
+	_, err := updateConfig(apiSource(r), "delete port "+portName, func(config *bridge.Config) error {
+		for i := 0; i < len(config.Ports); i++ {
+			if config.Ports[i].Name == portName {
+				foundPortConfig = config.Ports[i]
+				foundIdx = i
+				break
+			}
+		}
+		if foundIdx < 0 {
+			return errors.New("no such port " + portName + " in configuration file")
+		}
+		config.Ports = append(config.Ports[:foundIdx], config.Ports[foundIdx+1:]...)
+		return nil
+	})
+	if foundIdx < 0 {
+		answerError(&w)
+		return
+	}
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(foundPortConfig)
+}
+
+func handlerPortLinesGet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
+
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	lines, err := port.Lines()
+	if err != nil {
+		answerPortError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(lines)
+}
+
+func handlerPortLinesPut(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
+
+	var update bridge.ModemLinesUpdate
 
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
@@ -144,99 +328,505 @@ func handlerPortPut(w http.ResponseWriter, r *http.Request) {
 		answerError(&w)
 		return
 	}
-	if err := json.Unmarshal(body, &portConfig); err != nil {
+	if err := json.Unmarshal(body, &update); err != nil {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(422) // unprocessable entity
 		json.NewEncoder(w).Encode(nil)
 		return
 	}
 
-	logger("webpanel", LogInfo, "changing config for port "+portConfig.Name)
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
 
-	changingConfig := readConfig(configFilename)
+	logger("webpanel", LogInfo, "setting modem lines for port "+portName)
 
-	if portConfig.Name != portName {
-		answerError(&w)
+	lines, err := port.SetLines(update)
+	if err != nil {
+		answerPortError(w, err)
 		return
 	}
 
-	for i := 0; i < len(changingConfig.Ports); i++ {
-		if changingConfig.Ports[i].Name == portName {
-			changingConfig.Ports[i] = portConfig
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 
-			changingConfig.saveToFile(configFilename)
+	json.NewEncoder(w).Encode(lines)
+}
 
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusCreated)
+func handlerPortBreak(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
 
-			json.NewEncoder(w).Encode(portConfig)
+	var request struct {
+		Duration int `json:"duration"` // milliseconds
+	}
 
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		answerError(&w)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		answerError(&w)
+		return
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(422) // unprocessable entity
+			json.NewEncoder(w).Encode(nil)
 			return
 		}
 	}
 
-	answerError(&w)
-	return
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	err = port.SendBreak(time.Duration(request.Duration) * time.Millisecond)
+	if err != nil {
+		answerPortError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(nil)
 }
 
-func handlerPortDelete(w http.ResponseWriter, r *http.Request) {
+func handlerPortAutobaud(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	portName := vars["portName"]
 
-	logger("webpanel", LogInfo, "deleting config for port "+portName)
+	var request struct {
+		bridge.AutobaudConfig
+		Apply bool `json:"apply"`
+	}
 
-	changingConfig := readConfig(configFilename)
+	if !decodeRequestBody(w, r, &request) {
+		return
+	}
 
-	foundIdx := -1
-	foundPortConfig := PortConfig{}
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	logger("webpanel", LogInfo, "detecting baudrate for port "+portName)
+
+	result, err := port.DetectBaudRate(request.AutobaudConfig)
+	var notRunning *bridge.PortNotRunningError
+	if errors.As(err, &notRunning) {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	if request.Apply {
+		// Saved first, so that nothing changes when it cannot be kept across restarts
+		description := "detected baudrate " + strconv.Itoa(result.BaudRate) + " on port " + portName
+		_, err := updateConfig(apiSource(r), description, func(config *bridge.Config) error {
+			for i := range config.Ports {
+				if config.Ports[i].Name == portName {
+					config.Ports[i].BaudRate = result.BaudRate
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			answerConfigError(w, err)
+			return
+		}
 
-	for i := 0; i < len(changingConfig.Ports); i++ {
-		if changingConfig.Ports[i].Name == portName {
-			foundPortConfig = changingConfig.Ports[i]
-			foundIdx = i
-			break
+		if err := port.SetBaudRate(result.BaudRate); err != nil {
+			answerErrorStatus(&w, 422, errors.New("saved the detected baudrate but could not apply it: "+err.Error()))
+			return
 		}
+		result.Applied = true
 	}
 
-	if foundIdx >= 0 {
-		changingConfig.Ports = append(changingConfig.Ports[:foundIdx], changingConfig.Ports[foundIdx+1:]...)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 
-		changingConfig.saveToFile(configFilename)
+	json.NewEncoder(w).Encode(result)
+}
 
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusCreated)
+func handlerPortStatus(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
 
-		json.NewEncoder(w).Encode(foundPortConfig)
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
 		return
 	}
 
-	answerError(&w)
-	return
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(port.Status())
+}
+
+func handlerPortStart(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
+
+	logger("webpanel", LogInfo, "requested start of port "+portName)
+
+	answerPortLifecycle(w, portName, (*bridge.Port).Start)
+}
+
+func handlerPortStop(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
+
+	logger("webpanel", LogInfo, "requested stop of port "+portName)
+
+	answerPortLifecycle(w, portName, (*bridge.Port).Stop)
+}
+
+func handlerPortRestart(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
+
+	logger("webpanel", LogInfo, "requested restart of port "+portName)
+
+	answerPortLifecycle(w, portName, (*bridge.Port).Restart)
+}
+
+func handlerPortPause(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
+
+	logger("webpanel", LogInfo, "requested pause of port "+portName)
+
+	answerPortLifecycle(w, portName, (*bridge.Port).Pause)
+}
+
+func handlerPortResume(w http.ResponseWriter, r *http.Request) {
+	portName := mux.Vars(r)["portName"]
+
+	logger("webpanel", LogInfo, "requested resume of port "+portName)
+
+	answerPortLifecycle(w, portName, (*bridge.Port).Resume)
+}
+
+// answerPortLifecycle : run a lifecycle operation on a port of the running configuration
+// and answer with the resulting port state
+func answerPortLifecycle(w http.ResponseWriter, portName string, operation func(*bridge.Port) error) {
+	port, err := manager.Port(portName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := operation(port); err != nil {
+		answerErrorStatus(&w, http.StatusConflict, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":  portName,
+		"state": port.Status().State,
+	})
 }
 
 func handlerFreePortNames(w http.ResponseWriter, r *http.Request) {
-	changingConfig := readConfig(configFilename)
+	changingConfig, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// With ?resolve=true, also tell which tty each definition currently resolves to
+	type FreePort struct {
+		Name    string `json:"name"`
+		TTY     string `json:"tty"`
+		Present bool   `json:"present"`
+	}
+	resolve := r.URL.Query().Get("resolve") == "true"
 
 	var data []string
+	var resolvedData []FreePort
 
-	for _, portDefinition := range definitions.PortDefinitions {
-		_, getPortError := getPortConfig(changingConfig, portDefinition.PortName)
+	for _, portDefinition := range manager.Definitions().PortDefinitions {
+		_, getPortError := changingConfig.Port(portDefinition.PortName)
 		if getPortError != nil {
 			data = append(data, portDefinition.PortName)
+			if resolve {
+				ttyName, err := manager.ResolvePortDefinition(portDefinition)
+				resolvedData = append(resolvedData, FreePort{portDefinition.PortName, ttyName, err == nil && bridge.DevicePresent(ttyName)})
+			}
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
+	if resolve {
+		json.NewEncoder(w).Encode(resolvedData)
+		return
+	}
 	json.NewEncoder(w).Encode(data)
 }
 
+func handlerDevices(w http.ResponseWriter, r *http.Request) {
+	type DeviceDescription struct {
+		bridge.SerialDevice
+		ClaimedBy string `json:"claimedBy,omitempty"`
+	}
+	var data []DeviceDescription
+
+	claimed := manager.ClaimedDevices()
+
+	for _, device := range bridge.ListSerialDevices() {
+		data = append(data, DeviceDescription{device, claimed[device.TTY]})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(data)
+}
+
+func handlerDeviceDefine(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deviceName := vars["deviceName"]
+
+	var request struct {
+		Name    string `json:"name"`
+		MatchBy string `json:"matchBy"`
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		answerError(&w)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		answerError(&w)
+		return
+	}
+	if err := json.Unmarshal(body, &request); err != nil || request.Name == "" {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(422) // unprocessable entity
+		json.NewEncoder(w).Encode(nil)
+		return
+	}
+
+	device, err := bridge.FindSerialDevice(deviceName)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	if portName, ok := manager.ClaimedDevices()[device.TTY]; ok {
+		answerErrorStatus(&w, http.StatusConflict, errors.New(deviceName+" is already defined as "+portName))
+		return
+	}
+
+	portDefinition, err := bridge.DefinitionForDevice(device, request.Name, request.MatchBy)
+	if err != nil {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	logger("webpanel", LogInfo, "defining port "+request.Name+" for device "+deviceName)
+
+	err = addPortDefinition(portDefinition)
+	if err != nil {
+		answerErrorStatus(&w, http.StatusConflict, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(portDefinition)
+}
+
+func handlerDefinitionsGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(manager.Definitions())
+}
+
+func handlerPortDefinitionsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(manager.Definitions().PortDefinitions)
+}
+
+func handlerPortDefinitionGet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
+
+	currentDefinitions := manager.Definitions()
+	i, found := currentDefinitions.Find(portName)
+	if !found {
+		answerErrorStatus(&w, http.StatusNotFound, errors.New("no such port name "+portName+" in definitions file"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(currentDefinitions.PortDefinitions[i])
+}
+
+func handlerPortDefinitionPost(w http.ResponseWriter, r *http.Request) {
+	var portDefinition bridge.PortDefinition
+
+	if !decodeRequestBody(w, r, &portDefinition) {
+		return
+	}
+
+	logger("webpanel", LogInfo, "adding definition for port "+portDefinition.PortName)
+
+	err := addPortDefinition(portDefinition)
+	if err != nil {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+
+	json.NewEncoder(w).Encode(portDefinition)
+}
+
+func handlerPortDefinitionPut(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
+
+	var portDefinition bridge.PortDefinition
+
+	if !decodeRequestBody(w, r, &portDefinition) {
+		return
+	}
+
+	if portDefinition.PortName != portName {
+		answerErrorStatus(&w, 422, errors.New("port name cannot be changed"))
+		return
+	}
+
+	logger("webpanel", LogInfo, "changing definition for port "+portName)
+
+	_, err := manager.UpdateDefinitions(func(definitions *bridge.Definitions) error {
+		i, found := definitions.Find(portName)
+		if !found {
+			return errors.New("no such port name " + portName + " in definitions file")
+		}
+		definitions.PortDefinitions[i] = portDefinition
+		return nil
+	})
+	if err != nil {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(portDefinition)
+}
+
+func handlerPortDefinitionDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	portName := vars["portName"]
+
+	if _, err := manager.Config().Port(portName); err == nil {
+		answerErrorStatus(&w, http.StatusConflict, errors.New("port "+portName+" is in use by the running configuration"))
+		return
+	}
+	if changingConfig, err := readCandidateConfig(); err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	} else if _, err := changingConfig.Port(portName); err == nil {
+		answerErrorStatus(&w, http.StatusConflict, errors.New("port "+portName+" is in use by the configuration file"))
+		return
+	}
+
+	logger("webpanel", LogInfo, "deleting definition for port "+portName)
+
+	var deleted bridge.PortDefinition
+	_, err := manager.UpdateDefinitions(func(definitions *bridge.Definitions) error {
+		i, found := definitions.Find(portName)
+		if !found {
+			return errors.New("no such port name " + portName + " in definitions file")
+		}
+		deleted = definitions.PortDefinitions[i]
+		definitions.PortDefinitions = append(definitions.PortDefinitions[:i], definitions.PortDefinitions[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(deleted)
+}
+
+func handlerBaudratesPut(w http.ResponseWriter, r *http.Request) {
+	var baudRates []int
+
+	if !decodeRequestBody(w, r, &baudRates) {
+		return
+	}
+
+	candidateConfig, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
+
+	logger("webpanel", LogInfo, "changing baudrates")
+
+	// The ports of both configurations must keep a baudrate that is allowed
+	var inUse error
+	_, err = manager.UpdateDefinitions(func(definitions *bridge.Definitions) error {
+		definitions.BaudRates = baudRates
+		if err := definitions.Validate(); err != nil {
+			return err
+		}
+		if err := manager.Config().Validate(*definitions); err != nil {
+			inUse = errors.New("running configuration: " + err.Error())
+		} else if err := candidateConfig.Validate(*definitions); err != nil {
+			inUse = errors.New("configuration file: " + err.Error())
+		}
+		return inUse
+	})
+	if inUse != nil {
+		answerErrorStatus(&w, http.StatusConflict, inUse)
+		return
+	} else if err != nil {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(baudRates)
+}
+
 func handlerBaudrates(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(definitions.BaudRates)
+	json.NewEncoder(w).Encode(manager.Definitions().BaudRates)
 }
 
 func handlerListenIPs(w http.ResponseWriter, r *http.Request) {
@@ -277,9 +867,113 @@ func handlerListenIPs(w http.ResponseWriter, r *http.Request) {
 func handlerReloadConfigAndRestartThreads(w http.ResponseWriter, r *http.Request) {
 	logger("webpanel", LogInfo, "requested threads restart")
 
-	config = readConfig(configFilename)
+	result, err := commitConfig(0)
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result.ConfigDiff)
+}
+
+// handlerConfigApply : commit the candidate configuration (config.json) to the running ports, or with
+// ?dryRun=true only report which ports would be affected; with ?confirmTimeout=N the commit is
+// rolled back unless confirmed through /api/config/confirm within N seconds
+func handlerConfigApply(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	confirmTimeout, err := parseConfirmTimeout(r.URL.Query().Get("confirmTimeout"))
+	if err != nil {
+		answerErrorStatus(&w, http.StatusBadRequest, err)
+		return
+	}
+
+	var result CommitResult
+	if dryRun {
+		newConfig, err := readCandidateConfig()
+		if err != nil {
+			answerErrorStatus(&w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := newConfig.Validate(manager.Definitions()); err != nil {
+			answerValidationError(w, err)
+			return
+		}
+		result.ConfigDiff = bridge.DiffConfig(manager.Config(), newConfig)
+	} else {
+		logger("webpanel", LogInfo, "requested configuration apply")
+		result, err = commitConfig(confirmTimeout)
+		if err != nil {
+			answerConfigError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(struct {
+		DryRun bool `json:"dryRun"`
+		CommitResult
+	}{dryRun, result})
+}
+
+// handlerConfigCandidate : the configuration being edited, saved in config.json
+func handlerConfigCandidate(w http.ResponseWriter, r *http.Request) {
+	config, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(config)
+}
+
+// handlerConfigRunning : the configuration the ports are running with
+func handlerConfigRunning(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(manager.Config())
+}
+
+// handlerConfigPending : changes a commit of the candidate configuration would make, and the
+// deadline of the commit waiting to be confirmed, if any
+func handlerConfigPending(w http.ResponseWriter, r *http.Request) {
+	candidate, err := readCandidateConfig()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
+
+	changes := diffConfigs(manager.Config(), candidate)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(struct {
+		Pending bool `json:"pending"`
+		ConfigChanges
+		ConfirmBy *time.Time `json:"confirmBy,omitempty"`
+	}{
+		len(changes.Added) > 0 || len(changes.Removed) > 0 || len(changes.Changed) > 0,
+		changes,
+		pendingCommitDeadline(),
+	})
+}
 
-	restartAllThreads()
+// handlerConfigConfirm : keep the configuration of a commit made with confirmTimeout
+func handlerConfigConfirm(w http.ResponseWriter, r *http.Request) {
+	if err := confirmCommit(); err != nil {
+		answerErrorStatus(&w, http.StatusConflict, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
@@ -287,11 +981,139 @@ func handlerReloadConfigAndRestartThreads(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(nil)
 }
 
+// handlerConfigDiscard : throw away the changes to the candidate configuration
+func handlerConfigDiscard(w http.ResponseWriter, r *http.Request) {
+	logger("webpanel", LogInfo, "discarding the pending configuration changes")
+
+	config, err := discardCandidateConfig(apiSource(r))
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(config)
+}
+
+// handlerConfigHistory : list the saved versions of config.json, oldest first, without their content
+func handlerConfigHistory(w http.ResponseWriter, r *http.Request) {
+	configFileMutex.Lock()
+	history, err := readConfigHistory()
+	configFileMutex.Unlock()
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return
+	}
+
+	versions := []ConfigVersion{}
+	for _, version := range history {
+		version.Config = nil
+		versions = append(versions, version)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(versions)
+}
+
+// historyVersion : the version of the history named by the request path, answers 404 when there is none
+func historyVersion(w http.ResponseWriter, r *http.Request) (ConfigVersion, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	version, err := configVersion(id)
+	if errors.Is(err, errNoSuchConfigVersion) {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return ConfigVersion{}, false
+	}
+	if err != nil {
+		answerErrorStatus(&w, http.StatusInternalServerError, err)
+		return ConfigVersion{}, false
+	}
+	return version, true
+}
+
+func handlerConfigVersion(w http.ResponseWriter, r *http.Request) {
+	version, ok := historyVersion(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(version)
+}
+
+// handlerConfigVersionDiff : changes going from a version to config.json, or to another
+// version with ?to={id}
+func handlerConfigVersionDiff(w http.ResponseWriter, r *http.Request) {
+	version, ok := historyVersion(w, r)
+	if !ok {
+		return
+	}
+
+	var target bridge.Config
+	if to := r.URL.Query().Get("to"); to != "" {
+		id, err := strconv.Atoi(to)
+		if err != nil {
+			answerErrorStatus(&w, http.StatusBadRequest, err)
+			return
+		}
+		other, err := configVersion(id)
+		if errors.Is(err, errNoSuchConfigVersion) {
+			answerErrorStatus(&w, http.StatusNotFound, err)
+			return
+		}
+		if err != nil {
+			answerErrorStatus(&w, http.StatusInternalServerError, err)
+			return
+		}
+		target = *other.Config
+	} else {
+		current, err := readCandidateConfig()
+		if err != nil {
+			answerErrorStatus(&w, http.StatusInternalServerError, err)
+			return
+		}
+		target = current
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(diffConfigs(*version.Config, target))
+}
+
+// handlerConfigVersionRollback : write a version back to config.json, it is applied as any other change
+func handlerConfigVersionRollback(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	logger("webpanel", LogInfo, "rolling back the configuration to version "+strconv.Itoa(id))
+
+	config, err := rollbackConfig(id, apiSource(r))
+	if errors.Is(err, errNoSuchConfigVersion) {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		answerConfigError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(config)
+}
+
 func handlerStatistics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(getPublicStatistics(&statistics))
+	json.NewEncoder(w).Encode(manager.Statistics())
 }
 
 func handlerSystemLog(w http.ResponseWriter, r *http.Request) {
@@ -301,9 +1123,81 @@ func handlerSystemLog(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, getLogString())
 }
 
+// decodeRequestBody : read a JSON request body, answering 422 when it cannot be decoded
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		answerError(&w)
+		return false
+	}
+	if err := r.Body.Close(); err != nil {
+		answerError(&w)
+		return false
+	}
+	if err := json.Unmarshal(body, data); err != nil {
+		answerErrorStatus(&w, 422, err) // unprocessable entity
+		return false
+	}
+	return true
+}
+
 func answerError(w *http.ResponseWriter) {
 	(*w).Header().Set("Content-Type", "application/json; charset=UTF-8")
 	(*w).WriteHeader(http.StatusCreated)
 
 	json.NewEncoder(*w).Encode(nil)
 }
+
+// answerPortError : answer with the error of an operation on the serial port of a port
+func answerPortError(w http.ResponseWriter, err error) {
+	var notRunning *bridge.PortNotRunningError
+	if errors.As(err, &notRunning) {
+		answerErrorStatus(&w, http.StatusNotFound, err)
+		return
+	}
+	answerErrorStatus(&w, http.StatusInternalServerError, err)
+}
+
+// answerConfigError : answer with the error of a change to the configuration file,
+// 422 with the field list when it did not validate
+func answerConfigError(w http.ResponseWriter, err error) {
+	var invalid *bridge.ValidationError
+	if errors.As(err, &invalid) {
+		answerValidationError(w, err)
+		return
+	}
+	answerErrorStatus(&w, http.StatusInternalServerError, err)
+}
+
+// apiSource : source of a change made through the API, recorded in the configuration history
+func apiSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "api " + host
+}
+
+// answerValidationError : answer 422 with every problem found in a configuration
+func answerValidationError(w http.ResponseWriter, err error) {
+	var invalid *bridge.ValidationError
+	if !errors.As(err, &invalid) {
+		answerErrorStatus(&w, 422, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(422) // unprocessable entity
+
+	json.NewEncoder(w).Encode(struct {
+		Error  string              `json:"error"`
+		Errors []bridge.FieldError `json:"errors"`
+	}{invalid.Error(), invalid.Errors})
+}
+
+func answerErrorStatus(w *http.ResponseWriter, status int, err error) {
+	(*w).Header().Set("Content-Type", "application/json; charset=UTF-8")
+	(*w).WriteHeader(status)
+
+	json.NewEncoder(*w).Encode(map[string]string{"error": err.Error()})
+}